@@ -2,21 +2,343 @@
 package gha
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sethvargo/go-githubactions"
+	"gopkg.in/yaml.v3"
 )
 
+var action = githubactions.New()
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
 // InGitHubActions indicates whether this application is being run within the
 // GitHub Actions environment.
 func InGitHubActions() bool {
 	return os.Getenv("GITHUB_ACTIONS") == "true"
 }
 
+// InGitLabCI indicates whether this application is being run within GitLab
+// CI.
+func InGitLabCI() bool {
+	return os.Getenv("GITLAB_CI") == "true"
+}
+
+// InCI indicates whether this application is being run within a supported CI
+// environment, i.e. GitHub Actions or GitLab CI.
+func InCI() bool {
+	return InGitHubActions() || InGitLabCI()
+}
+
+// Metadata describes the workflow run and the commit it was triggered for.
+type Metadata struct {
+	// Name of the CI system, GitHub Actions or GitLab CI.
+	CI string
+	// Owner and name of the repository, e.g. octocat/Hello-World.
+	Repository string
+	// SHA of the commit.
+	Commit string
+	// Ref that triggered the workflow, e.g. refs/heads/main.
+	Ref string
+	// Name of the user that triggered the workflow.
+	Actor string
+	// Name of the workflow.
+	Workflow string
+	// URL of the workflow run.
+	JobURL string
+	// Pull request the workflow was triggered for. This is empty if the
+	// workflow was not triggered by a pull request event.
+	PullRequest PullRequest
+}
+
+// PullRequest describes the pull request from the event payload.
+type PullRequest struct {
+	Number int
+	Title  string
+	// Login of the user that opened the pull request.
+	Author string
+}
+
+// GetMetadata returns the metadata of the current workflow run. Fields that are
+// not available are left empty. Within GitLab CI, the metadata is read from
+// the predefined variables of the pipeline instead.
+func GetMetadata() Metadata {
+	if InGitLabCI() {
+		return gitLabMetadata()
+	}
+
+	m := Metadata{
+		CI:         "GitHub Actions",
+		Repository: os.Getenv("GITHUB_REPOSITORY"),
+		Commit:     os.Getenv("GITHUB_SHA"),
+		Ref:        os.Getenv("GITHUB_REF"),
+		Actor:      os.Getenv("GITHUB_ACTOR"),
+		Workflow:   os.Getenv("GITHUB_WORKFLOW"),
+	}
+
+	serverURL, runID := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_RUN_ID")
+	if serverURL != "" && m.Repository != "" && runID != "" {
+		m.JobURL = fmt.Sprintf("%v/%v/actions/runs/%v", serverURL, m.Repository, runID)
+	}
+
+	if eventPath := os.Getenv("GITHUB_EVENT_PATH"); eventPath != "" {
+		pr, err := readPullRequest(eventPath)
+		if err != nil {
+			Debugf("Could not read event payload: %v", err)
+		}
+		m.PullRequest = pr
+	}
+	return m
+}
+
+// gitLabMetadata returns the metadata of the current GitLab CI job, merge
+// requests take the place of pull requests. GitLab does not expose the author
+// of a merge request, so PullRequest.Author is left empty.
+func gitLabMetadata() Metadata {
+	m := Metadata{
+		CI:         "GitLab CI",
+		Repository: os.Getenv("CI_PROJECT_PATH"),
+		Commit:     os.Getenv("CI_COMMIT_SHA"),
+		Actor:      os.Getenv("GITLAB_USER_LOGIN"),
+		Workflow:   os.Getenv("CI_PIPELINE_NAME"),
+		JobURL:     os.Getenv("CI_JOB_URL"),
+	}
+
+	switch {
+	case os.Getenv("CI_COMMIT_BRANCH") != "":
+		m.Ref = "refs/heads/" + os.Getenv("CI_COMMIT_BRANCH")
+	case os.Getenv("CI_COMMIT_TAG") != "":
+		m.Ref = "refs/tags/" + os.Getenv("CI_COMMIT_TAG")
+	}
+
+	if iid, err := strconv.Atoi(os.Getenv("CI_MERGE_REQUEST_IID")); err == nil {
+		m.Ref = fmt.Sprintf("refs/merge-requests/%v/head", iid)
+		m.PullRequest = PullRequest{
+			Number: iid,
+			Title:  os.Getenv("CI_MERGE_REQUEST_TITLE"),
+		}
+	}
+	return m
+}
+
+// readPullRequest reads the pull request from the event payload at path. The
+// pull request is empty for events other than pull_request and
+// pull_request_target.
+func readPullRequest(path string) (PullRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PullRequest{}, err
+	}
+
+	var event struct {
+		PullRequest *struct {
+			Number int    `json:"number"`
+			Title  string `json:"title"`
+			User   struct {
+				Login string `json:"login"`
+			} `json:"user"`
+		} `json:"pull_request"`
+	}
+	err = json.Unmarshal(data, &event)
+	if err != nil {
+		return PullRequest{}, fmt.Errorf("could not parse event payload: %w", err)
+	}
+	if event.PullRequest == nil {
+		return PullRequest{}, nil
+	}
+	return PullRequest{
+		Number: event.PullRequest.Number,
+		Title:  event.PullRequest.Title,
+		Author: event.PullRequest.User.Login,
+	}, nil
+}
+
+// LoadEnvFile sets the variables defined in the dotenv file at path, e.g.
+// INPUT_WORKSPACE=my-workspace, to run outside of GitHub Actions. Variables
+// that are already set in the environment take precedence. Empty lines and
+// lines starting with # are ignored, values may be quoted.
+func LoadEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open env file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(text, "export "), "=")
+		if !ok {
+			return fmt.Errorf("could not parse line %v of env file, expected KEY=VALUE", line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if _, exists := os.LookupEnv(key); exists {
+			continue
+		}
+		err = os.Setenv(key, value)
+		if err != nil {
+			return fmt.Errorf("could not set %v from env file: %w", key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read env file: %w", err)
+	}
+	return nil
+}
+
+// SetDefaultInputs sets the inputs that are empty to their value in defaults,
+// like GitHub Actions does with the defaults of action.yaml. Defaults with
+// expressions, e.g. ${{ github.repository }}, can not be evaluated and are
+// skipped.
+func SetDefaultInputs(defaults map[string]string) {
+	for name, value := range defaults {
+		if value == "" || strings.Contains(value, "${{") || getInput(name) != "" {
+			continue
+		}
+		os.Setenv("INPUT_"+strings.ToUpper(strings.ReplaceAll(name, " ", "_")), value)
+	}
+}
+
+// configFileNames are the names FindConfigFile looks for, in order.
+var configFileNames = []string{".tfe-run.yml", ".tfe-run.yaml"}
+
+// FindConfigFile returns the path of the .tfe-run.yml file in dir, or an empty
+// string if dir does not have one.
+func FindConfigFile(dir string) string {
+	for _, name := range configFileNames {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// LoadConfigFile sets the inputs defined in the YAML file at path, e.g.
+// "workspace: my-workspace". Inputs that are set explicitly take precedence,
+// an input is not considered set if it is empty or equal to its value in
+// defaults. Lists are joined into values separated by newlines.
+func LoadConfigFile(path string, defaults map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	var config map[string]interface{}
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return fmt.Errorf("could not parse config file: %w", err)
+	}
+
+	for name, v := range config {
+		if !isDefaulted(name, defaults) {
+			continue
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("could not parse %v in config file: %w", name, err)
+		}
+		os.Setenv("INPUT_"+strings.ToUpper(strings.ReplaceAll(name, " ", "_")), value)
+	}
+	return nil
+}
+
+// isDefaulted indicates whether the input with the given name was not set
+// explicitly, i.e. it is empty or equal to its value in defaults. Defaults
+// with expressions are compared to their expansion, see expandDefault.
+func isDefaulted(name string, defaults map[string]string) bool {
+	current := getInput(name)
+	if current == "" {
+		return true
+	}
+	value := defaults[normalizeInputName(name)]
+	if expanded, ok := expandDefault(value); ok {
+		value = expanded
+	}
+	return current == value
+}
+
+var githubExpression = regexp.MustCompile(`\$\{\{\s*github\.(\w+)\s*\}\}`)
+
+// expandDefault expands the expressions of the github context in value, e.g.
+// ${{ github.sha }}, like GitHub Actions does for the defaults of action.yaml.
+// They are read from the corresponding GITHUB_* environment variables. ok is
+// false if value has other expressions, which can not be expanded.
+func expandDefault(value string) (expanded string, ok bool) {
+	expanded = githubExpression.ReplaceAllStringFunc(value, func(expression string) string {
+		name := githubExpression.FindStringSubmatch(expression)[1]
+		return os.Getenv("GITHUB_" + strings.ToUpper(name))
+	})
+	return expanded, !strings.Contains(expanded, "${{")
+}
+
+// DefaultedInputs returns the names of the inputs of the struct v, tagged as
+// for PopulateFromInputs, that are empty or equal to their value in defaults,
+// and the names of the inputs that were set explicitly. Names are sorted.
+func DefaultedInputs(v interface{}, defaults map[string]string) (defaulted, explicit []string) {
+	structType := reflect.TypeOf(v)
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+
+	defaulted, explicit = []string{}, []string{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		inputName, _ := parseTagOptions(field.Tag.Get("gha"))
+		if inputName == "" {
+			inputName = field.Name
+		}
+		inputName = normalizeInputName(inputName)
+
+		if isDefaulted(inputName, defaults) {
+			defaulted = append(defaulted, inputName)
+		} else {
+			explicit = append(explicit, inputName)
+		}
+	}
+	sort.Strings(defaulted)
+	sort.Strings(explicit)
+	return defaulted, explicit
+}
+
+// configValue converts a value of the config file to the string value of an
+// input.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		lines := make([]string, len(v))
+		for i, item := range v {
+			lines[i] = fmt.Sprint(item)
+		}
+		return strings.Join(lines, "\n"), nil
+	case map[string]interface{}:
+		return "", errors.New("objects are not supported")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
 // PopulateFromInputs will populate the given struct with inputs supplied by
 // the GitHub Actions environment. Fields that should be populated must be
 // tagged with `gha:"<name of input>"`. If the empty string is given (`gha:""`)
@@ -31,6 +353,7 @@ func InGitHubActions() bool {
 //	    RunID     string `gha:"run-id,required"`
 //	    Directory string `gha:""`
 //	    DryRun    bool   `gha:"dry-run"`
+//	    Timeout   time.Duration
 //	}
 func PopulateFromInputs(v interface{}) (err error) {
 	rv := reflect.ValueOf(v)
@@ -51,7 +374,7 @@ func PopulateFromInputs(v interface{}) (err error) {
 			inputName = field.Name
 		}
 
-		value := githubactions.GetInput(inputName)
+		value := getInput(inputName)
 
 		if isRequired && value == "" {
 			return fmt.Errorf("field %v is required but was not supplied", field.Name)
@@ -63,23 +386,61 @@ func PopulateFromInputs(v interface{}) (err error) {
 			return fmt.Errorf("field %v can not be set, is it exported?", field.Name)
 		}
 
-		switch valueField.Kind() {
-		case reflect.String:
+		switch {
+		case valueField.Type() == durationType:
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("could not parse input for field %v as duration, value: %v: %w", field.Name, value, err)
+			}
+			valueField.SetInt(int64(duration))
+		case valueField.Kind() == reflect.String:
 			valueField.SetString(value)
-		case reflect.Bool:
+		case valueField.Kind() == reflect.Int:
+			intValue, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("could not parse input for field %v as integer, value: %v: %w", field.Name, value, err)
+			}
+			valueField.SetInt(int64(intValue))
+		case valueField.Kind() == reflect.Bool:
 			boolValue, err := strconv.ParseBool(value)
 			if err != nil {
 				return fmt.Errorf("could not parse input for field %v as bool, value: %v: %w", field.Name, value, err)
 			}
 			valueField.SetBool(boolValue)
 		default:
-			return fmt.Errorf("fields of type %v are not supported, only strings and booleans are", valueField.Kind())
+			return fmt.Errorf("fields of type %v are not supported, only strings, booleans, integers and durations are", valueField.Kind())
 		}
 	}
 
 	return nil
 }
 
+// getInput returns the input with the given name. Inputs are looked up
+// ignoring case and treating dashes and underscores alike, so both
+// INPUT_WAIT_FOR_COMPLETION and INPUT_WAIT-FOR-COMPLETION are found for
+// wait-for-completion.
+func getInput(name string) string {
+	if value := action.GetInput(name); value != "" {
+		return value
+	}
+
+	want := normalizeInputName(name)
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(strings.ToUpper(key), "INPUT_") {
+			continue
+		}
+		if normalizeInputName(strings.TrimPrefix(strings.ToUpper(key), "INPUT_")) == want {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func normalizeInputName(name string) string {
+	return strings.NewReplacer("_", "-", " ", "-").Replace(strings.ToLower(name))
+}
+
 func parseTagOptions(tag string) (inputName string, isRequired bool) {
 	if tag == "" {
 		return "", false
@@ -97,7 +458,38 @@ func parseTagOptions(tag string) (inputName string, isRequired bool) {
 	return
 }
 
+// DebugEnabled indicates whether step debug logging is enabled, either with
+// the ACTIONS_STEP_DEBUG secret or by re-running the job with debug logging.
+func DebugEnabled() bool {
+	return os.Getenv("ACTIONS_STEP_DEBUG") == "true" || os.Getenv("RUNNER_DEBUG") == "1"
+}
+
+// Debugf writes a debug message to the log with the ::debug:: workflow
+// command. Messages are only written when step debug logging is enabled.
+func Debugf(format string, args ...interface{}) {
+	if !DebugEnabled() {
+		return
+	}
+	action.Debugf(format, args...)
+}
+
+// Warningf writes a warning message to the log, it is also shown as an
+// annotation on the workflow run.
+func Warningf(format string, args ...interface{}) {
+	action.Warningf(format, args...)
+}
+
+// WriteWarning writes a warning annotation with the given title.
+func WriteWarning(title, msg string) {
+	action.WithFieldsMap(map[string]string{"title": title}).Warningf("%s", msg)
+}
+
+// AddMask registers value as a secret, it is masked in the log from then on.
+func AddMask(value string) {
+	action.AddMask(value)
+}
+
 // WriteOutput writes an output parameter.
 func WriteOutput(name, value string) {
-	githubactions.SetOutput(name, value)
+	action.SetOutput(name, value)
 }
@@ -1,9 +1,13 @@
 package gha
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/sethvargo/go-githubactions"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,7 +15,8 @@ type testStruct struct {
 	Required   string `gha:"required-field,required"`
 	Optional   string `gha:"optional-field"`
 	WithoutTag string
-	Boolean    bool `gha:"boolean"`
+	Boolean    bool          `gha:"boolean"`
+	Duration   time.Duration `gha:"duration"`
 }
 
 func TestPopulateFromInputs(t *testing.T) {
@@ -19,6 +24,7 @@ func TestPopulateFromInputs(t *testing.T) {
 	os.Setenv("INPUT_REQUIRED-FIELD", "foo")
 	os.Setenv("INPUT_WITHOUTTAG", "bar")
 	os.Setenv("INPUT_BOOLEAN", "true")
+	os.Setenv("INPUT_DURATION", "1m30s")
 
 	var ts testStruct
 
@@ -29,6 +35,46 @@ func TestPopulateFromInputs(t *testing.T) {
 	assert.Equal(t, "", ts.Optional)
 	assert.Equal(t, "bar", ts.WithoutTag)
 	assert.Equal(t, true, ts.Boolean)
+	assert.Equal(t, 90*time.Second, ts.Duration)
+}
+
+func TestPopulateFromInputs_normalizedNames(t *testing.T) {
+	for _, key := range []string{
+		"INPUT_OPTIONAL-FIELD",
+		"INPUT_OPTIONAL_FIELD",
+		"input_optional_field",
+		"INPUT_Optional-Field",
+		"INPUT_OPTIONAL FIELD",
+	} {
+		t.Run(key, func(t *testing.T) {
+			os.Clearenv()
+			os.Setenv("INPUT_REQUIRED-FIELD", "foo")
+			os.Setenv("INPUT_BOOLEAN", "false")
+			os.Setenv("INPUT_DURATION", "0s")
+			os.Setenv(key, "bar")
+
+			var ts testStruct
+
+			err := PopulateFromInputs(&ts)
+
+			assert.NoError(t, err)
+			assert.Equal(t, "bar", ts.Optional)
+		})
+	}
+}
+
+func TestPopulateFromInputs_invalidDurationInput(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("INPUT_REQUIRED-FIELD", "foo")
+	os.Setenv("INPUT_BOOLEAN", "true")
+	os.Setenv("INPUT_DURATION", "bar")
+
+	var ts testStruct
+
+	err := PopulateFromInputs(&ts)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "could not parse input for field Duration as duration")
 }
 
 func TestPopulateFromInputs_invalidInputType(t *testing.T) {
@@ -73,7 +119,7 @@ func TestPopulateFromInputs_unsupportedFieldType(t *testing.T) {
 	os.Clearenv()
 
 	type unsupportedStruct struct {
-		Number int `gha:"number"`
+		Number float64 `gha:"number"`
 	}
 
 	var testStruct unsupportedStruct
@@ -81,5 +127,354 @@ func TestPopulateFromInputs_unsupportedFieldType(t *testing.T) {
 	err := PopulateFromInputs(&testStruct)
 
 	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "fields of type int are not supported")
+	assert.Contains(t, err.Error(), "fields of type float64 are not supported")
+}
+
+func TestPopulateFromInputs_integer(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("INPUT_NUMBER", "3")
+
+	var ts struct {
+		Number int `gha:"number"`
+	}
+
+	err := PopulateFromInputs(&ts)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, ts.Number)
+
+	os.Setenv("INPUT_NUMBER", "three")
+
+	err = PopulateFromInputs(&ts)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "could not parse input for field Number as integer")
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("INPUT_WORKSPACE", "from-env")
+
+	path := filepath.Join(t.TempDir(), ".env")
+	err := os.WriteFile(path, []byte(`# Local inputs
+INPUT_WORKSPACE=from-file
+INPUT_TYPE=apply
+
+export INPUT_MESSAGE="Queued locally"
+INPUT_TARGETS='module.app'
+`), 0644)
+	assert.NoError(t, err)
+
+	err = LoadEnvFile(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", os.Getenv("INPUT_WORKSPACE"))
+	assert.Equal(t, "apply", os.Getenv("INPUT_TYPE"))
+	assert.Equal(t, "Queued locally", os.Getenv("INPUT_MESSAGE"))
+	assert.Equal(t, "module.app", os.Getenv("INPUT_TARGETS"))
+}
+
+func TestLoadEnvFile_invalidLine(t *testing.T) {
+	os.Clearenv()
+
+	path := filepath.Join(t.TempDir(), ".env")
+	err := os.WriteFile(path, []byte("INPUT_TYPE=apply\nINPUT_WORKSPACE\n"), 0644)
+	assert.NoError(t, err)
+
+	err = LoadEnvFile(path)
+
+	assert.EqualError(t, err, "could not parse line 2 of env file, expected KEY=VALUE")
+}
+
+func TestFindConfigFile(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.Equal(t, "", FindConfigFile(dir))
+
+	path := filepath.Join(dir, ".tfe-run.yaml")
+	assert.NoError(t, os.WriteFile(path, nil, 0644))
+
+	assert.Equal(t, path, FindConfigFile(dir))
+
+	path = filepath.Join(dir, ".tfe-run.yml")
+	assert.NoError(t, os.WriteFile(path, nil, 0644))
+
+	assert.Equal(t, path, FindConfigFile(dir))
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("INPUT_WORKSPACE", "from-input")
+	os.Setenv("INPUT_TYPE", "apply")
+	os.Setenv("INPUT_WAIT-FOR-COMPLETION", "false")
+	os.Setenv("INPUT_TARGETS", "")
+
+	path := filepath.Join(t.TempDir(), ".tfe-run.yml")
+	err := os.WriteFile(path, []byte(`workspace: from-file
+organization: my-org
+type: plan
+wait-for-completion: true
+timeout: 30m
+max-polls: 100
+targets:
+  - module.app
+  - module.db
+`), 0644)
+	assert.NoError(t, err)
+
+	err = LoadConfigFile(path, map[string]string{"type": "apply", "wait-for-completion": "false"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "from-input", getInput("workspace"))
+	assert.Equal(t, "my-org", getInput("organization"))
+	assert.Equal(t, "plan", getInput("type"))
+	assert.Equal(t, "true", getInput("wait-for-completion"))
+	assert.Equal(t, "30m", getInput("timeout"))
+	assert.Equal(t, "100", getInput("max-polls"))
+	assert.Equal(t, "module.app\nmodule.db", getInput("targets"))
+}
+
+func TestSetDefaultInputs(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("INPUT_TYPE", "plan")
+	os.Setenv("INPUT_WAIT_FOR_COMPLETION", "false")
+
+	SetDefaultInputs(map[string]string{
+		"type":                "apply",
+		"wait-for-completion": "true",
+		"timeout":             "1h",
+		"targets":             "",
+		"organization":        "${{ github.repository_owner }}",
+	})
+
+	assert.Equal(t, "plan", getInput("type"))
+	assert.Equal(t, "false", getInput("wait-for-completion"))
+	assert.Equal(t, "1h", getInput("timeout"))
+	assert.Equal(t, "", getInput("targets"))
+	assert.Equal(t, "", getInput("organization"))
+}
+
+func TestDefaultedInputs(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("INPUT_WORKSPACE", "my-workspace")
+	os.Setenv("INPUT_TYPE", "apply")
+	os.Setenv("INPUT_WAIT-FOR-COMPLETION", "true")
+	os.Setenv("INPUT_TIMEOUT", "")
+
+	var input struct {
+		Workspace         string        `gha:"workspace,required"`
+		Type              string        `gha:"type"`
+		WaitForCompletion bool          `gha:"wait-for-completion"`
+		Timeout           time.Duration `gha:""`
+		Message           string
+	}
+	defaulted, explicit := DefaultedInputs(&input, map[string]string{"type": "apply", "wait-for-completion": "false"})
+
+	assert.Equal(t, []string{"message", "timeout", "type"}, defaulted)
+	assert.Equal(t, []string{"wait-for-completion", "workspace"}, explicit)
+}
+
+func TestDefaultedInputs_expressions(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("GITHUB_REPOSITORY_OWNER", "octocat")
+	os.Setenv("GITHUB_SHA", "ffac537e6cbbf934b08745a378932722df287a53")
+	os.Setenv("INPUT_ORGANIZATION", "octocat")
+	os.Setenv("INPUT_MESSAGE", "Queued (commit: ffac537e6cbbf934b08745a378932722df287a53)")
+	os.Setenv("INPUT_REPO", "octocat/infra")
+	os.Setenv("INPUT_OTHER", "value")
+
+	var input struct {
+		Organization string `gha:"organization"`
+		Message      string `gha:"message"`
+		Repo         string `gha:"repo"`
+		Other        string `gha:"other"`
+	}
+	defaulted, explicit := DefaultedInputs(&input, map[string]string{
+		"organization": "${{ github.repository_owner }}",
+		"message":      "Queued (commit: ${{ github.sha }})",
+		"repo":         "${{ github.repository }}",
+		"other":        "${{ inputs.organization }}",
+	})
+
+	assert.Equal(t, []string{"message", "organization"}, defaulted)
+	assert.Equal(t, []string{"other", "repo"}, explicit)
+}
+
+func TestLoadConfigFile_explicitInputs(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("INPUT_TYPE", "destroy")
+
+	path := filepath.Join(t.TempDir(), ".tfe-run.yml")
+	assert.NoError(t, os.WriteFile(path, []byte("type: plan\n"), 0644))
+
+	err := LoadConfigFile(path, map[string]string{"type": "apply"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "destroy", getInput("type"))
+}
+
+func TestLoadConfigFile_missingFile(t *testing.T) {
+	os.Clearenv()
+
+	err := LoadConfigFile(filepath.Join(t.TempDir(), ".tfe-run.yml"), nil)
+
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoadConfigFile_invalid(t *testing.T) {
+	os.Clearenv()
+
+	path := filepath.Join(t.TempDir(), ".tfe-run.yml")
+	assert.NoError(t, os.WriteFile(path, []byte("workspace:\n  name: foo\n"), 0644))
+
+	err := LoadConfigFile(path, nil)
+
+	assert.EqualError(t, err, "could not parse workspace in config file: objects are not supported")
+}
+
+func TestDebugf(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(a *githubactions.Action) { action = a }(action)
+	action = githubactions.New(githubactions.WithWriter(&buf))
+
+	os.Clearenv()
+	Debugf("Polling run %v", "run-1")
+
+	assert.Equal(t, "", buf.String())
+
+	os.Setenv("ACTIONS_STEP_DEBUG", "true")
+	Debugf("Polling run %v", "run-1")
+
+	assert.Equal(t, "::debug::Polling run run-1\n", buf.String())
+
+	buf.Reset()
+	os.Clearenv()
+	os.Setenv("RUNNER_DEBUG", "1")
+	Debugf("Polling run %v", "run-2")
+
+	assert.Equal(t, "::debug::Polling run run-2\n", buf.String())
+}
+
+func TestWriteWarning(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(a *githubactions.Action) { action = a }(action)
+	action = githubactions.New(githubactions.WithWriter(&buf))
+
+	WriteWarning("Deprecated attribute", "null_resource.foo: the attribute bar is deprecated")
+
+	assert.Equal(t, "::warning title=Deprecated attribute::null_resource.foo: the attribute bar is deprecated\n", buf.String())
+}
+
+func TestGetMetadata(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("GITHUB_REPOSITORY", "octocat/Hello-World")
+	os.Setenv("GITHUB_SHA", "ffac537e6cbbf934b08745a378932722df287a53")
+	os.Setenv("GITHUB_REF", "refs/heads/main")
+	os.Setenv("GITHUB_ACTOR", "octocat")
+	os.Setenv("GITHUB_WORKFLOW", "CI")
+	os.Setenv("GITHUB_SERVER_URL", "https://github.com")
+	os.Setenv("GITHUB_RUN_ID", "1658821493")
+
+	m := GetMetadata()
+
+	assert.Equal(t, Metadata{
+		CI:         "GitHub Actions",
+		Repository: "octocat/Hello-World",
+		Commit:     "ffac537e6cbbf934b08745a378932722df287a53",
+		Ref:        "refs/heads/main",
+		Actor:      "octocat",
+		Workflow:   "CI",
+		JobURL:     "https://github.com/octocat/Hello-World/actions/runs/1658821493",
+	}, m)
+}
+
+func TestGetMetadata_gitLab(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("GITLAB_CI", "true")
+	os.Setenv("GITHUB_SHA", "must-be-ignored")
+	os.Setenv("CI_PROJECT_PATH", "octocat/hello-world")
+	os.Setenv("CI_COMMIT_SHA", "ffac537e6cbbf934b08745a378932722df287a53")
+	os.Setenv("CI_COMMIT_BRANCH", "main")
+	os.Setenv("GITLAB_USER_LOGIN", "octocat")
+	os.Setenv("CI_PIPELINE_NAME", "CI")
+	os.Setenv("CI_JOB_URL", "https://gitlab.com/octocat/hello-world/-/jobs/1658821493")
+
+	assert.Equal(t, Metadata{
+		CI:         "GitLab CI",
+		Repository: "octocat/hello-world",
+		Commit:     "ffac537e6cbbf934b08745a378932722df287a53",
+		Ref:        "refs/heads/main",
+		Actor:      "octocat",
+		Workflow:   "CI",
+		JobURL:     "https://gitlab.com/octocat/hello-world/-/jobs/1658821493",
+	}, GetMetadata())
+
+	os.Unsetenv("CI_COMMIT_BRANCH")
+	os.Setenv("CI_MERGE_REQUEST_IID", "42")
+	os.Setenv("CI_MERGE_REQUEST_TITLE", "Add staging environment")
+
+	m := GetMetadata()
+
+	assert.Equal(t, "refs/merge-requests/42/head", m.Ref)
+	assert.Equal(t, PullRequest{Number: 42, Title: "Add staging environment"}, m.PullRequest)
+}
+
+func TestInCI_gitLabOnly(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("GITLAB_CI", "true")
+	os.Setenv("CI_PROJECT_PATH", "octocat/hello-world")
+	os.Setenv("CI_COMMIT_BRANCH", "main")
+	os.Setenv("INPUT_REQUIRED-FIELD", "foo")
+
+	assert.False(t, InGitHubActions())
+	assert.True(t, InCI())
+
+	SetDefaultInputs(map[string]string{"boolean": "true", "duration": "1m30s"})
+
+	var ts testStruct
+
+	err := PopulateFromInputs(&ts)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", ts.Required)
+	assert.Equal(t, true, ts.Boolean)
+	assert.Equal(t, 90*time.Second, ts.Duration)
+
+	m := GetMetadata()
+
+	assert.Equal(t, "octocat/hello-world", m.Repository)
+	assert.Equal(t, "refs/heads/main", m.Ref)
+}
+
+func TestGetMetadata_pullRequestEvent(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("GITHUB_EVENT_PATH", filepath.Join("testdata", "pull_request.json"))
+
+	assert.Equal(t, PullRequest{
+		Number: 42,
+		Title:  "Add staging environment",
+		Author: "octocat",
+	}, GetMetadata().PullRequest)
+}
+
+func TestGetMetadata_pushEvent(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("GITHUB_EVENT_PATH", filepath.Join("testdata", "push.json"))
+
+	assert.Equal(t, PullRequest{}, GetMetadata().PullRequest)
+}
+
+func TestGetMetadata_missingEventPayload(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("GITHUB_EVENT_PATH", filepath.Join(t.TempDir(), "event.json"))
+
+	assert.Equal(t, PullRequest{}, GetMetadata().PullRequest)
+}
+
+func TestGetMetadata_missingRunID(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("GITHUB_REPOSITORY", "octocat/Hello-World")
+	os.Setenv("GITHUB_SERVER_URL", "https://github.com")
+
+	assert.Equal(t, "", GetMetadata().JobURL)
 }
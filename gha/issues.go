@@ -0,0 +1,115 @@
+package gha
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// issueLabel is added to issues created by ReportIssue, it is used to find
+// them again.
+const issueLabel = "tfe-run"
+
+// GitHub is a minimal client for the GitHub REST API.
+type GitHub struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// NewGitHub creates a GitHub client authenticated with token, sending requests
+// with client. If client is nil, http.DefaultClient is used. The API URL of
+// the current GitHub instance is used, falling back to https://api.github.com.
+func NewGitHub(token string, client *http.Client) *GitHub {
+	baseURL := os.Getenv("GITHUB_API_URL")
+	if baseURL == "" {
+		baseURL = "https://api.github.com"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &GitHub{
+		token:   token,
+		baseURL: baseURL,
+		client:  client,
+	}
+}
+
+type issue struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	HTMLURL string `json:"html_url"`
+}
+
+// ReportIssue comments body on the open issue in repo (owner/name) with the
+// given title. If no such issue exists, a new one is created. It returns the
+// URL of the issue.
+func (g *GitHub) ReportIssue(ctx context.Context, repo, title, body string) (string, error) {
+	var issues []issue
+	query := url.Values{"state": {"open"}, "labels": {issueLabel}, "per_page": {"100"}}
+	err := g.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%v/issues?%v", repo, query.Encode()), nil, &issues)
+	if err != nil {
+		return "", fmt.Errorf("could not list issues: %w", err)
+	}
+
+	for _, i := range issues {
+		if i.Title == title {
+			err = g.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%v/issues/%v/comments", repo, i.Number), map[string]interface{}{
+				"body": body,
+			}, nil)
+			if err != nil {
+				return "", fmt.Errorf("could not comment on issue #%v: %w", i.Number, err)
+			}
+			return i.HTMLURL, nil
+		}
+	}
+
+	var created issue
+	err = g.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%v/issues", repo), map[string]interface{}{
+		"title":  title,
+		"body":   body,
+		"labels": []string{issueLabel},
+	}, &created)
+	if err != nil {
+		return "", fmt.Errorf("could not create issue: %w", err)
+	}
+	return created.HTMLURL, nil
+}
+
+func (g *GitHub) do(ctx context.Context, method, path string, body, v interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
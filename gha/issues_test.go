@@ -0,0 +1,98 @@
+package gha
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeGitHub struct {
+	issues   []issue
+	created  []map[string]interface{}
+	comments map[string][]string
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/octocat/infra/issues":
+		if r.URL.Query().Get("labels") != "tfe-run" || r.URL.Query().Get("state") != "open" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(f.issues)
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/octocat/infra/issues":
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.created = append(f.created, body)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(issue{Number: 2, HTMLURL: "https://github.com/octocat/infra/issues/2"})
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/octocat/infra/issues/1/comments":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		f.comments["1"] = append(f.comments["1"], body["body"])
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestGitHub(t *testing.T, fake *fakeGitHub) *GitHub {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	t.Setenv("GITHUB_API_URL", server.URL)
+	return NewGitHub("token", server.Client())
+}
+
+func TestReportIssue_create(t *testing.T) {
+	fake := &fakeGitHub{
+		issues:   []issue{{Number: 1, Title: "Something else"}},
+		comments: map[string][]string{},
+	}
+	g := newTestGitHub(t, fake)
+
+	issueURL, err := g.ReportIssue(context.Background(), "octocat/infra", "Run failed", "Details")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.com/octocat/infra/issues/2", issueURL)
+	assert.Len(t, fake.created, 1)
+	assert.Equal(t, "Run failed", fake.created[0]["title"])
+	assert.Equal(t, "Details", fake.created[0]["body"])
+	assert.Equal(t, []interface{}{"tfe-run"}, fake.created[0]["labels"])
+	assert.Empty(t, fake.comments)
+}
+
+func TestReportIssue_update(t *testing.T) {
+	fake := &fakeGitHub{
+		issues:   []issue{{Number: 1, Title: "Run failed", HTMLURL: "https://github.com/octocat/infra/issues/1"}},
+		comments: map[string][]string{},
+	}
+	g := newTestGitHub(t, fake)
+
+	issueURL, err := g.ReportIssue(context.Background(), "octocat/infra", "Run failed", "Details")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.com/octocat/infra/issues/1", issueURL)
+	assert.Empty(t, fake.created)
+	assert.Equal(t, []string{"Details"}, fake.comments["1"])
+}
+
+func TestReportIssue_unauthorized(t *testing.T) {
+	g := newTestGitHub(t, &fakeGitHub{})
+	g.token = "invalid"
+
+	_, err := g.ReportIssue(context.Background(), "octocat/infra", "Run failed", "Details")
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+}
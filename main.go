@@ -1,29 +1,170 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	_ "embed"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/danny02/tfe-run/gha"
 	tfe "github.com/hashicorp/go-tfe"
+	"gopkg.in/yaml.v3"
 )
 
 type input struct {
-	Token             string `gha:"token,required"`
-	Organization      string `gha:"organization,required"`
-	Workspace         string `gha:"workspace,required"`
-	Message           string
-	Type              string
-	Targets           string
-	Replacements      string
-	WaitForCompletion bool `gha:"wait-for-completion"`
-	PrintOutputs      bool `gha:"print-outputs"`
+	Token                       string `gha:"token"`
+	TokenFile                   string `gha:"token-file"`
+	Organization                string `gha:"organization"`
+	Workspace                   string `gha:"workspace,required"`
+	Address                     string
+	UIAddress                   string `gha:"ui-address"`
+	Proxy                       string
+	Message                     string
+	Description                 string
+	Reason                      string
+	ConfigurationVersion        string `gha:"configuration-version"`
+	SoftFailPolicyIsSuccess     bool   `gha:"soft-fail-policy-is-success"`
+	DumpWorkspaceSettings       bool   `gha:"dump-workspace-settings"`
+	ArtifactsDir                string `gha:"artifacts-dir"`
+	FireAndForget               bool   `gha:"fire-and-forget"`
+	Lock                        bool
+	LockTimeout                 time.Duration `gha:"lock-timeout"`
+	Type                        string
+	Targets                     string
+	TargetsJSON                 string `gha:"targets-json"`
+	Replacements                string
+	ReplacementsJSON            string        `gha:"replacements-json"`
+	WaitForCompletion           bool          `gha:"wait-for-completion"`
+	PrintOutputs                bool          `gha:"print-outputs"`
+	ValidateTargetsAgainstState bool          `gha:"validate-targets-against-state"`
+	InfracostPlanPath           string        `gha:"infracost-plan-path"`
+	AllowedModulePrefixes       string        `gha:"allowed-module-prefixes"`
+	OnMissingState              string        `gha:"on-missing-state"`
+	ReportPrePlanTasks          bool          `gha:"report-pre-plan-tasks"`
+	WaitForPostApplyTasks       bool          `gha:"wait-for-post-apply-tasks"`
+	ResumeRunID                 string        `gha:"resume-run-id"`
+	CancelOnInterrupt           bool          `gha:"cancel-on-interrupt"`
+	AnnotatePlanWarnings        bool          `gha:"annotate-plan-warnings"`
+	OnCancel                    string        `gha:"on-cancel"`
+	OnEmptyApply                string        `gha:"on-empty-apply"`
+	PolicyOverride              string        `gha:"policy-override"`
+	ReportAssessment            bool          `gha:"report-assessment"`
+	FailOnDrift                 bool          `gha:"fail-on-drift"`
+	RequireTargetsForDestroy    bool          `gha:"require-targets-for-destroy"`
+	Stage                       string        `gha:"stage"`
+	ApplyRunID                  string        `gha:"apply-run-id"`
+	AttachLatest                bool          `gha:"attach-latest"`
+	FlattenOutputs              string        `gha:"flatten-outputs"`
+	RequiredOutputs             string        `gha:"required-outputs"`
+	StateFile                   string        `gha:"state-file"`
+	PollStrategy                string        `gha:"poll-strategy"`
+	Check                       bool          `gha:"check"`
+	ApplyBranches               string        `gha:"apply-branches"`
+	BlockReplacementsOf         string        `gha:"block-replacements-of"`
+	ResultFile                  string        `gha:"result-file"`
+	OutputReadAttempts          int           `gha:"output-read-attempts"`
+	OutputReadInterval          time.Duration `gha:"output-read-interval"`
+	MaxPlanBytes                int           `gha:"max-plan-bytes"`
+	MaxPolls                    int           `gha:"max-polls"`
+	SkipDestroyIfEmpty          bool          `gha:"skip-destroy-if-empty"`
+	ExportOutputs               string        `gha:"export-outputs"`
+	AutoComment                 bool          `gha:"auto-comment"`
+	WaitForState                bool          `gha:"wait-for-state"`
+	CompactWarnings             bool          `gha:"compact-warnings"`
+	NativeOutputs               bool          `gha:"native-outputs"`
+	InitialPollDelay            time.Duration `gha:"initial-poll-delay"`
+	StuckStageTimeout           time.Duration `gha:"stuck-stage-timeout"`
+	ReportDefaultedInputs       bool          `gha:"report-defaulted-inputs"`
+	WorkspaceReadAttempts       int           `gha:"workspace-read-attempts"`
+	WorkspaceReadInterval       time.Duration `gha:"workspace-read-interval"`
+	GitHubToken                 string        `gha:"github-token"`
+	IssueRepo                   string        `gha:"issue-repo"`
+	SuccessWebhookURL           string        `gha:"success-webhook-url"`
+	FailureWebhookURL           string        `gha:"failure-webhook-url"`
+
+	// Inputs that can be defaulted by a profile, these are strings so we can
+	// tell whether they were set explicitly.
+	Profile                    string
+	Timeout                    string
+	QueueTimeout               string `gha:"queue-timeout"`
+	ExecutionTimeout           string `gha:"execution-timeout"`
+	RequireDestroyConfirmation string `gha:"require-destroy-confirmation"`
+	ConfirmDestroy             bool   `gha:"confirm-destroy"`
+}
+
+// settings holds the options that can be defaulted by a profile.
+type settings struct {
+	Timeout                    time.Duration
+	QueueTimeout               time.Duration
+	ExecutionTimeout           time.Duration
+	RequireDestroyConfirmation bool
+}
+
+// profiles are presets of settings, the empty profile is used when no profile
+// is given.
+var profiles = map[string]settings{
+	"": {
+		Timeout: defaultRunTimeout,
+	},
+	"dev": {
+		Timeout: 30 * time.Minute,
+	},
+	"prod": {
+		Timeout:                    2 * time.Hour,
+		RequireDestroyConfirmation: true,
+	},
+}
+
+// resolveSettings returns the settings of the selected profile, overridden by
+// the inputs that were set explicitly.
+func resolveSettings(in input) (settings, error) {
+	s, ok := profiles[in.Profile]
+	if !ok {
+		return s, fmt.Errorf("profile \"%s\" is not supported, must be dev or prod", in.Profile)
+	}
+
+	var err error
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"timeout", in.Timeout, &s.Timeout},
+		{"queue-timeout", in.QueueTimeout, &s.QueueTimeout},
+		{"execution-timeout", in.ExecutionTimeout, &s.ExecutionTimeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		*d.dst, err = time.ParseDuration(d.value)
+		if err != nil {
+			return s, fmt.Errorf("could not parse %v: %w", d.name, err)
+		}
+	}
+	if in.RequireDestroyConfirmation != "" {
+		s.RequireDestroyConfirmation, err = strconv.ParseBool(in.RequireDestroyConfirmation)
+		if err != nil {
+			return s, fmt.Errorf("could not parse require-destroy-confirmation: %w", err)
+		}
+	}
+	return s, nil
 }
 
 type ClientConfig struct {
@@ -34,6 +175,21 @@ type ClientConfig struct {
 	Organization string
 	// The workspace on Terraform Cloud.
 	Workspace string
+	// Address of the Terraform Cloud or Enterprise API. Defaults to
+	// https://app.terraform.io.
+	Address string
+	// Address the UI is served on, used to build links to runs. Defaults to
+	// Address.
+	UIAddress string
+	// URL of the proxy to send requests through. Defaults to the proxy
+	// configured by HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+	Proxy string
+	// How often to read the organization and the workspace if reading them
+	// fails with an error other than not found or unauthorized, and how long
+	// to wait before the first retry. The wait is doubled for every further retry. Defaults to 3
+	// attempts, starting at 1s.
+	WorkspaceReadAttempts int
+	WorkspaceReadInterval time.Duration
 }
 
 // Client is used to interact with the Run API of a single workspace on
@@ -41,34 +197,148 @@ type ClientConfig struct {
 type Client struct {
 	client    *tfe.Client
 	workspace *tfe.Workspace
+	uiAddress string
+	// Parsed state versions by ID, state versions are immutable so each one
+	// is only downloaded once.
+	states map[string]*minimalTerraformState
+
+	// OptionsMutator is invoked with the options of every new run before the
+	// run is created, e.g. to adjust them based on the environment. The
+	// default, nil, leaves the options as they are.
+	OptionsMutator func(*RunOptions)
+	// StatusMessages overrides how statuses are rendered in logs, errors and
+	// summaries, e.g. to localize them. Statuses without an entry are
+	// rendered with underscores replaced by spaces.
+	StatusMessages map[tfe.RunStatus]string
 }
 
 // NewClient creates a Client from ClientConfig.
 func NewClient(ctx context.Context, cfg ClientConfig) (*Client, error) {
+	httpClient, err := newHTTPClient(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
 	config := &tfe.Config{
-		Token: cfg.Token,
+		Address:    cfg.Address,
+		Token:      cfg.Token,
+		HTTPClient: httpClient,
 	}
 	tfeClient, err := tfe.NewClient(config)
 	if err != nil {
 		return nil, fmt.Errorf("could not create a new TFE tfeClient: %w", err)
 	}
 
-	w, err := tfeClient.Workspaces.Read(ctx, cfg.Organization, cfg.Workspace)
+	return newClient(ctx, tfeClient, cfg)
+}
+
+// newHTTPClient returns the HTTP client to communicate with the API. Requests
+// are sent through proxyURL, or the proxy from the environment if it is empty.
+func newHTTPClient(proxyURL string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func newClient(ctx context.Context, tfeClient *tfe.Client, cfg ClientConfig) (*Client, error) {
+	// Validate the token up front, an invalid token would otherwise only
+	// surface as a confusing "resource not found" error.
+	err := retryTransient(ctx, cfg, "organization", func() error {
+		_, err := tfeClient.Organizations.ReadEntitlements(ctx, cfg.Organization)
+		return err
+	})
+	if errors.Is(err, tfe.ErrUnauthorized) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		// Workspace scoped tokens can not read the organization, the
+		// workspace read below fails if the token has no access at all
+		gha.Debugf("Could not read organization '%v': %v", cfg.Organization, err)
+	}
+
+	var w *tfe.Workspace
+	err = retryTransient(ctx, cfg, "workspace", func() (err error) {
+		w, err = tfeClient.Workspaces.Read(ctx, cfg.Organization, cfg.Workspace)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("could not retrieve workspace '%v/%v': %w", cfg.Organization, cfg.Workspace, err)
 	}
 
+	uiAddress := cfg.UIAddress
+	if uiAddress == "" {
+		uiAddress = cfg.Address
+	}
+
 	c := Client{
 		client:    tfeClient,
 		workspace: w,
+		uiAddress: strings.TrimSuffix(uiAddress, "/"),
 	}
 	return &c, nil
 }
 
+// retryTransient calls read until it succeeds, retrying transient failures of
+// reading what with backoff as configured by ClientConfig.WorkspaceReadAttempts.
+func retryTransient(ctx context.Context, cfg ClientConfig, what string, read func() error) error {
+	attempts, interval := cfg.WorkspaceReadAttempts, cfg.WorkspaceReadInterval
+	if attempts <= 0 {
+		attempts = defaultWorkspaceReadAttempts
+	}
+	if interval <= 0 {
+		interval = defaultWorkspaceReadInterval
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := read()
+		if err == nil || attempt >= attempts || !isTransient(err) {
+			return err
+		}
+		gha.Debugf("Could not read %v, retrying in %v (attempt %v/%v): %v", what, interval, attempt+1, attempts, err)
+
+		err = sleepWithContext(ctx, interval)
+		if err != nil {
+			return err
+		}
+		interval *= 2
+	}
+}
+
+// isTransient indicates whether a request that failed with err may succeed
+// when it is retried.
+func isTransient(err error) bool {
+	return !errors.Is(err, tfe.ErrResourceNotFound) &&
+		!errors.Is(err, tfe.ErrUnauthorized) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// runURL returns the link to the run in the UI of Terraform Cloud.
+func (c *Client) runURL(runID string) string {
+	uiAddress := c.uiAddress
+	if uiAddress == "" {
+		uiAddress = tfe.DefaultAddress
+	}
+	return fmt.Sprintf("%v/app/%v/workspaces/%v/runs/%v", uiAddress, c.workspace.Organization.Name, c.workspace.Name, runID)
+}
+
 // RunOptions groups all options available when creating a new run.
 type RunOptions struct {
 	// Message to use as name of the run. This field is optional.
 	Message *string
+	// Label of an earlier configuration version to run against instead of
+	// the latest one. The label is matched against the ID, the VCS tag and the
+	// commit SHA of the configuration versions. This field is optional.
+	ConfigurationVersion string
+	// Reason the run was triggered, e.g. scheduled-drift. It is prepended to
+	// the message as [reason]. This field is optional.
+	Reason string
 	// The type of run to schedule.
 	Type RunType
 	// A list of resource addresses that are passed to the -target flag. For
@@ -80,6 +350,108 @@ type RunOptions struct {
 	// Whether we should wait for the non-speculative run to be applied. This
 	// will block until the run is finished.
 	WaitForCompletion bool
+	// Maximum time to wait for completion, defaults to one hour.
+	Timeout time.Duration
+	// Time to wait before polling the run for the first time. A run that was
+	// just created is usually still pending.
+	InitialPollDelay time.Duration
+	// Maximum time the run may wait in the queue before it starts. If
+	// exceeded, ErrQueueTimeout is returned. Zero means no limit.
+	QueueTimeout time.Duration
+	// Maximum time the run may take once it has started. If exceeded,
+	// ErrExecutionTimeout is returned. Zero means no limit.
+	ExecutionTimeout time.Duration
+	// Maximum time a new run may stay in one of the stages before planning,
+	// e.g. waiting for pre-plan run tasks. If exceeded, the run is canceled
+	// and recreated once, the second time ErrStuckStage is returned. Zero
+	// means no limit.
+	StuckStageTimeout time.Duration
+	// Optional comment that is posted on the run after creating it.
+	Comment *string
+	// Optional longer description of the run, Message being its title. It is
+	// posted as a comment on the run before Comment.
+	Description *string
+	// Whether a destroy run must have at least one target, so it only
+	// destroys the targeted resources instead of the whole workspace.
+	RequireTargetsForDestroy bool
+	// Whether every address in TargetAddrs must be present in the current
+	// state. If set, the run is not created when a target is missing.
+	ValidateTargetsAgainstState bool
+	// If set, every resource changed by the plan must have one of these
+	// addresses or be within one of them, e.g. module.app does not allow
+	// module.application. Otherwise the run is discarded, if
+	// possible, and an error is returned. This is only checked while waiting
+	// for completion.
+	AllowedModulePrefixes []string
+	// Whether the run should be canceled when ctx is canceled while waiting
+	// for completion, e.g. because the job was canceled.
+	CancelOnInterrupt bool
+	// What to do when the run has been canceled.
+	OnCancel CancelBehavior
+	// Which part of the run to execute. With StagePlan, waiting for
+	// completion stops once the run awaits confirmation. With StageApply, the
+	// run ApplyRunID is confirmed instead of creating a new run.
+	Stage Stage
+	// ID of the planned run to apply with StageApply.
+	ApplyRunID string
+	// What to do when the run awaits a policy override. This is only checked
+	// while waiting for completion.
+	OnPolicyOverride PolicyOverrideBehavior
+	// What to do when an apply run has no changes to apply. This is only
+	// checked while waiting for completion.
+	OnEmptyApply EmptyApplyBehavior
+	// Whether warnings from the plan should be emitted as GitHub Actions
+	// annotations once the run is finished.
+	AnnotatePlanWarnings bool
+	// Whether repeated plan warnings should be collapsed into a single
+	// annotation, similar to Terraform's -compact-warnings flag.
+	CompactWarnings bool
+	// ID of an existing run to wait for. If set, no new run is created and
+	// the options that configure a new run are ignored.
+	ResumeRunID string
+	// Whether to wait for the run that is currently active on the workspace
+	// instead of creating a new run. Like ResumeRunID, the options that
+	// configure a new run are ignored. If the workspace has no active run,
+	// ErrNoActiveRun is returned.
+	AttachLatest bool
+	// Path of a file the ID of the created run is written to. If the file
+	// already holds an unfinished run of this workspace and workflow run
+	// attempt, that run is resumed instead of creating a new one, e.g. when
+	// the step is restarted after a network failure. The file is removed once
+	// the run finished.
+	StateFile string
+	// Decides how often the run is polled while waiting for completion and
+	// when to give up. Defaults to polling at a fixed interval until Timeout.
+	PollStrategy PollStrategy
+	// Maximum number of times the run is polled while waiting for completion.
+	// If the run has not finished by then, ErrMaxPolls is returned. This
+	// applies in addition to Timeout, 0 means no limit.
+	MaxPolls int
+	// Whether a destroy run whose plan destroys nothing should be discarded
+	// instead of applied, and be treated as success. This is only possible
+	// while the run can be discarded. Requires WaitForCompletion.
+	SkipDestroyIfEmpty bool
+	// Whether the results of pre-plan run tasks should be reported once the
+	// run is finished. If a mandatory task failed, an error is returned.
+	ReportPrePlanTasks bool
+	// Addresses of resources and modules that must not be replaced or
+	// destroyed. If the plan does, the run is discarded and an error is
+	// returned. Requires WaitForCompletion.
+	BlockReplacementsOf []string
+	// Maximum size of the JSON plan in bytes, e.g. for policy engines that
+	// can not handle larger plans. If the plan exceeds it, the run is
+	// discarded and an error is returned. Requires WaitForCompletion, 0 means
+	// no limit.
+	MaxPlanBytes int
+	// Whether to return right after the run has been created. No completion
+	// status is produced, WaitForCompletion is ignored.
+	FireAndForget bool
+	// Whether a speculative plan that soft-failed policy checks should be
+	// treated as successful. The failed policies are reported either way.
+	SoftFailPolicyIsSuccess bool
+	// Whether to wait for the post-apply run tasks of an applied run and
+	// report their results. If a mandatory task failed, an error is returned.
+	WaitForPostApplyTasks bool
 }
 
 // RunType describes the type of run.
@@ -92,16 +464,175 @@ const (
 	RunTypeDestroy
 )
 
+// Stage describes which part of a run is executed, to plan and apply a run in
+// separate steps.
+type Stage int
+
+// Declaration of stages.
+const (
+	// StageFull creates a run and waits until it is finished.
+	StageFull Stage = iota
+	// StagePlan creates a run that is not applied automatically and waits
+	// until it is planned.
+	StagePlan
+	// StageApply confirms the planned run RunOptions.ApplyRunID and waits
+	// until it is finished.
+	StageApply
+)
+
+// CancelBehavior describes how to handle a run that has been canceled.
+type CancelBehavior int
+
+// Declaration of cancel behaviors.
+const (
+	// CancelFail returns an error.
+	CancelFail CancelBehavior = iota
+	// CancelSucceed treats the run as successful.
+	CancelSucceed
+	// CancelSkip treats the run as successful, but signals the caller to skip
+	// any further processing like reading outputs.
+	CancelSkip
+)
+
+// EmptyApplyBehavior describes how to handle an apply run whose plan has no
+// changes, so there is nothing to apply.
+type EmptyApplyBehavior int
+
+// Declaration of empty apply behaviors.
+const (
+	// EmptyApplySucceed treats the run as successful.
+	EmptyApplySucceed EmptyApplyBehavior = iota
+	// EmptyApplyWarn treats the run as successful, but emits a warning.
+	EmptyApplyWarn
+	// EmptyApplyFail returns ErrEmptyApply.
+	EmptyApplyFail
+)
+
+// PolicyOverrideBehavior describes how to handle a run whose soft-mandatory
+// policies failed and that awaits a policy override.
+type PolicyOverrideBehavior int
+
+// Declaration of policy override behaviors.
+const (
+	// PolicyOverrideWait keeps waiting until someone overrides the policies
+	// or discards the run.
+	PolicyOverrideWait PolicyOverrideBehavior = iota
+	// PolicyOverrideFail returns ErrPolicyOverrideRequired.
+	PolicyOverrideFail
+	// PolicyOverrideOverride overrides the failed policy checks and
+	// continues. The token must be permitted to override policies.
+	PolicyOverrideOverride
+)
+
 // RunOutput holds the data that is generated by a run.
 type RunOutput struct {
+	// ID of the run.
+	RunID string
+	// ID of the plan belonging to the run.
+	PlanID string
 	// URL to the run on Terraform Cloud.
 	RunURL string
+	// URLs to the plan and apply of the run on Terraform Cloud. ApplyURL is
+	// only set if the run has an apply.
+	PlanURL  string
+	ApplyURL string
 	// Whether this run has changes. After a speculative plan this would
 	// indicate whether an apply would cause changes, after a non-speculative
 	// plan this indicates whether the run has caused any changes.
 	// This is not populated for non-speculative runs on workspaces that do not
 	// have auto-apply configured or when WaitForCompletion is not set.
 	HasChanges *bool
+	// Whether the run has been applied. Unlike HasChanges, this is false for
+	// runs that finished after the plan. Like HasChanges, this is only
+	// populated after waiting for completion.
+	Applied *bool
+	// Addresses of the resources changed by the apply. This is only populated
+	// for runs that have been applied.
+	ChangedResources []string
+	// Results of the pre-plan run tasks. This is only populated if
+	// ReportPrePlanTasks is set.
+	PrePlanTaskResults []*tfe.TaskResult
+	// Results of the post-apply run tasks. This is only populated if
+	// WaitForPostApplyTasks is set and the run has been applied.
+	PostApplyTaskResults []*tfe.TaskResult
+	// Warnings reported by the plan. This is only populated if
+	// AnnotatePlanWarnings is set.
+	PlanWarnings []Diagnostic
+	// Status the run finished with. Like HasChanges, this is only populated
+	// after waiting for completion.
+	Status tfe.RunStatus
+	// Number of resources that were changed outside of Terraform. Like
+	// HasChanges, this is only populated after waiting for completion, and
+	// only if the run succeeded.
+	DriftCount *int
+	// Number of resources the plan adds, changes and destroys. Like
+	// HasChanges, this is only populated after waiting for completion.
+	ResourceCounts *ResourceCounts
+	// Number of runs in the run queue of the organization that were ahead of
+	// the run when it was created. This is only populated for new runs and if
+	// the token may read the run queue.
+	QueueDepth *int
+	// Time the apply completed. This is only populated for runs that have
+	// been applied.
+	AppliedAt *time.Time
+	// Terraform version the run used, or the version of the workspace if the
+	// run does not report it. Like HasChanges, this is only populated after
+	// waiting for completion.
+	TerraformVersion string
+	// Username of the user that created the run, e.g. when attaching to a run
+	// that was not created by tfe-run.
+	CreatedBy string
+	// Whether an existing run was used instead of creating a new one, e.g.
+	// with AttachLatest, ResumeRunID or StateFile.
+	ReusedExistingRun bool
+	// Time between creating the run and the start of its plan. Like
+	// HasChanges, this is only populated after waiting for completion, and
+	// only if both timestamps are known.
+	PlanQueueLatency *time.Duration
+	// Whether the run entered the policy override state, because one of its
+	// policy checks soft failed. Like HasChanges, this is only populated
+	// after waiting for completion.
+	PolicyOverrideRequired *bool
+}
+
+// ResourceCounts holds the number of resources affected by a plan.
+type ResourceCounts struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+}
+
+// String returns the counts in the compact form add/change/destroy, e.g.
+// 3/1/0.
+func (rc ResourceCounts) String() string {
+	return fmt.Sprintf("%v/%v/%v", rc.Add, rc.Change, rc.Destroy)
+}
+
+// Summary returns a single line describing the outcome of the run of o,
+// suitable for chat notifications.
+func (c *Client) Summary(o RunOutput) string {
+	var outcome string
+	switch msg, ok := c.StatusMessages[o.Status]; {
+	case ok:
+		outcome = msg
+	case o.Status == tfe.RunApplied:
+		outcome = "Applied"
+	case o.Status == tfe.RunPlannedAndFinished:
+		outcome = "Planned"
+	case o.Status == RunSkipped:
+		outcome = "Skipped empty destroy"
+	case o.Status == "":
+		outcome = "Queued run"
+	default:
+		outcome = fmt.Sprintf("Run %v", c.prettyPrint(o.Status))
+	}
+
+	succeeded := o.Status == tfe.RunApplied || o.Status == tfe.RunPlannedAndFinished
+	if succeeded && o.ResourceCounts != nil {
+		outcome = fmt.Sprintf("%v %v add / %v change / %v destroy",
+			outcome, o.ResourceCounts.Add, o.ResourceCounts.Change, o.ResourceCounts.Destroy)
+	}
+	return fmt.Sprintf("%v in %v — %v", outcome, c.workspace.Name, o.RunURL)
 }
 
 // Run creates a new run on Terraform Cloud.
@@ -109,33 +640,62 @@ type RunOutput struct {
 // If RunOptions.WaitForCompletion is set this method will block until the run
 // is finished, except if the run is non-speculative and the workspace has
 // disabled auto-apply (to avoid blocking indefinitely).
-// If the run does not complete within one hour, ErrTimeout is returned. This
-// will not cancel the remote operation.
+// If the run does not complete within RunOptions.Timeout, ErrTimeout is
+// returned. This will not cancel the remote operation.
 func (c *Client) Run(ctx context.Context, options RunOptions) (output RunOutput, err error) {
 	var r *tfe.Run
 
-	rOptions := tfe.RunCreateOptions{
-		Workspace:    c.workspace,
-		IsDestroy:    tfe.Bool(options.Type == RunTypeDestroy),
-		TargetAddrs:  options.TargetAddrs,
-		ReplaceAddrs: options.ReplaceAddrs,
-		Message:      options.Message,
+	resumeRunID := options.ResumeRunID
+	if resumeRunID == "" && options.StateFile != "" {
+		resumeRunID, err = c.readRunState(ctx, options.StateFile)
+		if err != nil {
+			return
+		}
+	}
+
+	switch {
+	case options.Stage == StageApply:
+		r, err = c.confirmRun(ctx, options.ApplyRunID)
+	case options.AttachLatest:
+		r, err = c.activeRun(ctx)
+	case resumeRunID != "":
+		r, err = c.client.Runs.Read(ctx, resumeRunID)
+		if err != nil {
+			err = fmt.Errorf("could not read run: %w", err)
+		}
+	default:
+		r, err = c.createRun(ctx, options)
+		if err == nil {
+			output.QueueDepth = c.queueDepth(ctx, r.ID)
+		}
+		if err == nil && options.StateFile != "" {
+			err = c.writeRunState(options.StateFile, r.ID)
+		}
 	}
-	r, err = c.client.Runs.Create(ctx, rOptions)
 	if err != nil {
-		err = fmt.Errorf("could not create run: %w", err)
 		return
 	}
 
-	output.RunURL = fmt.Sprintf(
-		"https://app.terraform.io/app/%v/workspaces/%v/runs/%v",
-		c.workspace.Organization.Name, c.workspace.Name, r.ID,
-	)
+	output.ReusedExistingRun = options.Stage == StageApply || options.AttachLatest || resumeRunID != ""
+	c.setRunOutput(ctx, &output, r)
 
-	fmt.Printf("Run %v has been queued\n", r.ID)
+	switch {
+	case options.Stage == StageApply:
+		fmt.Printf("Run %v has been confirmed\n", r.ID)
+	case options.AttachLatest:
+		fmt.Printf("Attached to run %v\n", r.ID)
+	case resumeRunID != "":
+		fmt.Printf("Resuming run %v\n", r.ID)
+	default:
+		fmt.Printf("Run %v has been queued\n", r.ID)
+	}
 	fmt.Printf("View the run online:\n")
 	fmt.Printf("%v\n", output.RunURL)
 
+	if options.FireAndForget {
+		fmt.Print("Fire-and-forget is enabled, won't wait for completion.\n")
+		return
+	}
 	if !options.WaitForCompletion {
 		return
 	}
@@ -144,204 +704,2843 @@ func (c *Client) Run(ctx context.Context, options RunOptions) (output RunOutput,
 	// the run itself wouldn't change anything the previous run could still be
 	// blocked while waiting for confirmation.
 	// Speculative runs/plans can always continue.
-	if !(options.Type == RunTypePlan) && !c.workspace.AutoApply {
+	// When planning or applying in stages, the run never waits for
+	// confirmation.
+	if !(options.Type == RunTypePlan) && !c.workspace.AutoApply && options.Stage == StageFull {
 		fmt.Print("Auto apply isn't enabled, won't wait for completion.\n")
 		return
 	}
 
 	var prevStatus tfe.RunStatus
+	planChecked := len(options.AllowedModulePrefixes) == 0 && len(options.BlockReplacementsOf) == 0 && options.MaxPlanBytes <= 0
+	destroyChecked := !(options.SkipDestroyIfEmpty && options.Type == RunTypeDestroy)
+	var destroySkipped bool
+	var policiesOverridden bool
+	var overrideRequired bool
+
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = defaultRunTimeout
+	}
 
-	err = pollWithContext(ctx, 60*time.Minute, func() (bool, error) {
-		r, err = c.client.Runs.Read(ctx, r.ID)
+	start := time.Now()
+	var executionStart time.Time
+	var polls int
+	var stageStart time.Time
+	var recreated bool
+
+	pollFn := func() (bool, error) {
+		latest, err := c.client.Runs.Read(ctx, r.ID)
 		if err != nil {
 			return false, fmt.Errorf("could not read run: %w", err)
 		}
+		r = latest
 
 		if prevStatus != r.Status {
-			fmt.Printf("Run status: %v\n", prettyPrint(r.Status))
+			fmt.Printf("Run status: %v\n", c.prettyPrint(r.Status))
 			prevStatus = r.Status
+			stageStart = time.Now()
 		}
 
-		return isEndStatus(r.Status), nil
-	})
+		if options.StuckStageTimeout > 0 && isPrePlan(r.Status) && time.Since(stageStart) > options.StuckStageTimeout {
+			if recreated || output.ReusedExistingRun {
+				return false, fmt.Errorf("%w, run %v has been %v for more than %v", ErrStuckStage, r.ID, c.prettyPrint(r.Status), options.StuckStageTimeout)
+			}
+			r, err = c.recreateRun(ctx, r, options)
+			if err != nil {
+				return false, err
+			}
+			recreated = true
+			prevStatus = ""
+			c.setRunOutput(ctx, &output, r)
+			output.QueueDepth = c.queueDepth(ctx, r.ID)
+			// The timeouts apply to the new run only
+			start = time.Now()
+			executionStart = time.Time{}
+			return false, nil
+		}
+
+		if isQueued(r.Status) {
+			if options.QueueTimeout > 0 && time.Since(start) > options.QueueTimeout {
+				return false, ErrQueueTimeout
+			}
+		} else {
+			if executionStart.IsZero() {
+				executionStart = time.Now()
+			}
+			if options.ExecutionTimeout > 0 && time.Since(executionStart) > options.ExecutionTimeout {
+				return false, ErrExecutionTimeout
+			}
+		}
+
+		if !planChecked && isPlanFinished(r.Status) {
+			planChecked = true
+			err = c.checkPlan(ctx, r, options)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if !destroyChecked && isPlanFinished(r.Status) && !isEndStatus(r.Status) {
+			destroyChecked = true
+			destroySkipped, err = c.skipEmptyDestroy(ctx, r)
+			if err != nil || destroySkipped {
+				return destroySkipped, err
+			}
+		}
+
+		if r.Status == tfe.RunPolicyOverride {
+			overrideRequired = true
+		}
+		if r.Status == tfe.RunPolicyOverride && !policiesOverridden {
+			switch options.OnPolicyOverride {
+			case PolicyOverrideFail:
+				err = c.reportPolicyChecks(ctx, r.ID)
+				if err != nil {
+					return false, err
+				}
+				return false, fmt.Errorf("%w, run %v", ErrPolicyOverrideRequired, r.ID)
+			case PolicyOverrideOverride:
+				err = c.overridePolicyChecks(ctx, r.ID)
+				if err != nil {
+					return false, err
+				}
+				policiesOverridden = true
+			}
+		}
+
+		done := isEndStatus(r.Status) || (options.Stage == StagePlan && isConfirmable(r))
+		polls++
+		if !done && options.MaxPolls > 0 && polls >= options.MaxPolls {
+			return false, fmt.Errorf("%w (%v)", ErrMaxPolls, options.MaxPolls)
+		}
+		return done, nil
+	}
+
+	strategy := options.PollStrategy
+	if strategy == nil {
+		strategy = FixedPollStrategy{Interval: pollInterval, Timeout: timeout}
+	}
+
+	err = sleepWithContext(ctx, options.InitialPollDelay)
+	if err == nil {
+		err = pollWithStrategy(ctx, strategy, func() tfe.RunStatus { return r.Status }, pollFn)
+	}
+	if errors.Is(err, context.Canceled) && options.CancelOnInterrupt {
+		c.cancel(r)
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrMaxPolls) {
+		err = fmt.Errorf("%w, last status of run was %v, view the run online: %v", err, c.prettyPrint(prevStatus), output.RunURL)
+	}
 	if err != nil {
 		err = fmt.Errorf("waiting for completion of run failed: %w", err)
 		return
 	}
+	if options.StateFile != "" && isEndStatus(r.Status) {
+		removeRunState(options.StateFile)
+	}
 
 	output.HasChanges = tfe.Bool(r.HasChanges)
+	output.Applied = tfe.Bool(r.Status == tfe.RunApplied)
+	output.Status = r.Status
+	output.TerraformVersion = r.TerraformVersion
+	if output.TerraformVersion == "" {
+		output.TerraformVersion = c.workspace.TerraformVersion
+	}
+	output.PlanQueueLatency = planQueueLatency(r)
+	output.PolicyOverrideRequired = tfe.Bool(overrideRequired || c.policyOverrideRequired(ctx, r))
+
+	plan, err := c.client.Plans.Read(ctx, r.Plan.ID)
+	if err != nil {
+		err = fmt.Errorf("could not read plan: %w", err)
+		return
+	}
+	output.ResourceCounts = &ResourceCounts{
+		Add:     plan.ResourceAdditions,
+		Change:  plan.ResourceChanges,
+		Destroy: plan.ResourceDestructions,
+	}
+
+	if options.AnnotatePlanWarnings {
+		output.PlanWarnings, err = c.planWarnings(ctx, r.Plan.ID)
+		if err != nil {
+			return
+		}
+		warnings := output.PlanWarnings
+		if options.CompactWarnings {
+			warnings = compactWarnings(warnings)
+		}
+		for _, d := range warnings {
+			gha.WriteWarning(d.Summary, d.message())
+		}
+	}
+
+	if options.ReportPrePlanTasks {
+		output.PrePlanTaskResults, err = c.checkTaskStage(ctx, r.ID, tfe.PrePlan)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.Status == tfe.RunPlannedAndFinished || r.Status == tfe.RunApplied {
+		// Drift and changed resources are informational, a JSON plan that
+		// can not be read, e.g. without permission to read plans, must not
+		// fail a successful run.
+		_, plan, planErr := c.readPlanJSON(ctx, r.Plan.ID)
+		if planErr != nil {
+			gha.Debugf("Could not read drift and changed resources: %v", planErr)
+		} else {
+			output.DriftCount = tfe.Int(len(plan.ResourceDrift))
+			if r.Status == tfe.RunApplied {
+				output.ChangedResources = plan.changedResources()
+			}
+		}
+	}
+	if r.Status == tfe.RunApplied && r.StatusTimestamps != nil && !r.StatusTimestamps.AppliedAt.IsZero() {
+		appliedAt := r.StatusTimestamps.AppliedAt
+		output.AppliedAt = &appliedAt
+	}
+
+	if options.WaitForPostApplyTasks && r.Status == tfe.RunApplied {
+		err = c.waitForTaskStage(ctx, r.ID, tfe.PostApply, timeout)
+		if err != nil {
+			return
+		}
+		output.PostApplyTaskResults, err = c.checkTaskStage(ctx, r.ID, tfe.PostApply)
+		if err != nil {
+			return
+		}
+	}
+
+	if destroySkipped {
+		fmt.Println("Destroy plan is empty, the apply has been skipped.")
+		output.Status = RunSkipped
+		return
+	}
+	if options.Stage == StagePlan && !isEndStatus(r.Status) {
+		fmt.Printf("Run has been planned, apply it with stage apply and apply-run-id %v.\n", r.ID)
+		return
+	}
 
 	switch r.Status {
 	case tfe.RunPlannedAndFinished:
 		fmt.Println("Run is planned and finished.")
+		if options.Type != RunTypeApply || r.HasChanges {
+			break
+		}
+		switch options.OnEmptyApply {
+		case EmptyApplyWarn:
+			gha.Warningf("Run %v has no changes to apply", r.ID)
+		case EmptyApplyFail:
+			err = fmt.Errorf("%w, run %v", ErrEmptyApply, r.ID)
+		}
 	case tfe.RunApplied:
 		fmt.Println("Run has been applied!")
+	case tfe.RunCanceled:
+		if options.OnCancel == CancelFail {
+			err = fmt.Errorf("run %v has been canceled", r.ID)
+			break
+		}
+		fmt.Println("Run has been canceled.")
+	case tfe.RunPolicySoftFailed:
+		err = c.reportPolicyChecks(ctx, r.ID)
+		if err != nil {
+			break
+		}
+		if options.SoftFailPolicyIsSuccess && options.Type == RunTypePlan {
+			fmt.Println("Run has soft-failed policy checks, treating it as success.")
+			break
+		}
+		err = fmt.Errorf("run %v finished with status %v", r.ID, c.prettyPrint(r.Status))
+	case tfe.RunDiscarded:
+		err = fmt.Errorf("run %v has been %v", r.ID, c.discardReason(ctx, r.ID))
+	case tfe.RunErrored:
+		err = c.erroredStage(ctx, r, plan)
+		if errors.Is(err, ErrPlanErrored) && options.Type == RunTypePlan {
+			if tail := c.planLogTail(ctx, r.Plan.ID); tail != "" {
+				err = fmt.Errorf("%w, last lines of the plan log:\n%v", err, tail)
+			}
+		}
 	default:
-		err = fmt.Errorf("run %v finished with status %v", r.ID, prettyPrint(r.Status))
+		err = fmt.Errorf("run %v finished with status %v", r.ID, c.prettyPrint(r.Status))
 	}
 
 	return
 }
 
-func isEndStatus(r tfe.RunStatus) bool {
-	// Run statuses: https://pkg.go.dev/github.com/hashicorp/go-tfe?tab=doc#RunStatus
-	// Documentation: https://www.terraform.io/docs/cloud/api/run.html#run-states
-	switch r {
-	case
-		tfe.RunPolicySoftFailed,
-		tfe.RunPlannedAndFinished,
-		tfe.RunApplied,
-		tfe.RunDiscarded,
-		tfe.RunErrored,
-		tfe.RunCanceled:
-		return true
+// skipEmptyDestroy discards the destroy run r if its plan does not destroy
+// anything. It returns whether the run has been discarded, which is not
+// possible anymore once the apply has started.
+func (c *Client) skipEmptyDestroy(ctx context.Context, r *tfe.Run) (bool, error) {
+	if r.Actions == nil || !r.Actions.IsDiscardable {
+		return false, nil
 	}
-	return false
-}
-
-func prettyPrint(r tfe.RunStatus) string {
-	return strings.ReplaceAll(string(r), "_", " ")
-}
-
-type terraformOutput struct {
-	Value     interface{} `json:"value"`
-	Sensitive bool        `json:"sensitive"`
-}
-
-type minimalTerraformState struct {
-	Outputs map[string]terraformOutput `json:"outputs"`
-}
-
-// GetTerraformOutputs retrieves the outputs from the current Terraform state.
-func (c *Client) GetTerraformOutputs(ctx context.Context, shouldPrint bool) (map[string]string, error) {
-	s, err := c.client.StateVersions.ReadCurrent(ctx, c.workspace.ID)
+	plan, err := c.client.Plans.Read(ctx, r.Plan.ID)
 	if err != nil {
-		return nil, fmt.Errorf("could not get current state: %w", err)
+		return false, fmt.Errorf("could not read plan: %w", err)
+	}
+	if plan.ResourceDestructions > 0 {
+		return false, nil
 	}
 
-	bytes, err := c.client.StateVersions.Download(ctx, s.DownloadURL)
+	err = c.client.Runs.Discard(ctx, r.ID, tfe.RunDiscardOptions{
+		Comment: tfe.String("Discarded by tfe-run: the destroy plan is empty"),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("could not download state: %w", err)
+		return false, fmt.Errorf("could not discard run: %w", err)
 	}
+	r.Status = tfe.RunDiscarded
+	return true, nil
+}
 
-	var state minimalTerraformState
-	err = json.Unmarshal(bytes, &state)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse state: %w", err)
+// erroredStage returns an error describing which stage of the errored run r
+// failed. plan is the plan of the run.
+func (c *Client) erroredStage(ctx context.Context, r *tfe.Run, plan *tfe.Plan) error {
+	if plan.Status == tfe.PlanErrored {
+		return fmt.Errorf("%w, run %v could not be planned", ErrPlanErrored, r.ID)
 	}
 
-	fmt.Printf("Outputs from current state:\n")
-	outputs := make(map[string]string)
-	for k, v := range state.Outputs {
-		// Marshal the value back into JSON
-		valueBytes, err := json.Marshal(v.Value)
+	if r.CostEstimate != nil {
+		ce, err := c.client.CostEstimates.Read(ctx, r.CostEstimate.ID)
 		if err != nil {
-			return nil, fmt.Errorf("Could not marshal value for key %s: %v", k, err)
+			return fmt.Errorf("could not read cost estimate: %w", err)
 		}
+		if ce.Status == tfe.CostEstimateErrored {
+			return fmt.Errorf("%w, run %v: %v", ErrCostEstimationErrored, r.ID, ce.ErrorMessage)
+		}
+	}
 
-		// Convert the JSON byte array to a string
-		outputs[k] = string(valueBytes)
-
-		if shouldPrint {
-			var value string
-			if v.Sensitive {
-				value = "***"
-			} else {
-				value = outputs[k]
+	if r.Apply != nil {
+		a, err := c.client.Applies.Read(ctx, r.Apply.ID)
+		if err != nil {
+			return fmt.Errorf("could not read apply: %w", err)
+		}
+		if a.Status == tfe.ApplyErrored {
+			applied := a.ResourceAdditions + a.ResourceChanges + a.ResourceDestructions
+			if applied > 0 {
+				return fmt.Errorf("%w, run %v applied %v resource changes before failing (%v added, %v changed, %v destroyed)",
+					ErrPartialApply, r.ID, applied, a.ResourceAdditions, a.ResourceChanges, a.ResourceDestructions)
 			}
-			fmt.Printf(" - %v: %v\n", k, value)
+			return fmt.Errorf("%w, run %v could not be applied", ErrApplyErrored, r.ID)
 		}
 	}
 
-	return outputs, nil
+	return fmt.Errorf("run %v finished with status %v", r.ID, c.prettyPrint(r.Status))
 }
 
-var (
-	// ErrTimeout is returned when an operation timed out.
-	ErrTimeout = errors.New("timed out while polling")
-)
-
-// pollWithContext will execute pollFn every 500 milliseconds until either
-// pollFn returns (true, nil) or (false, err). If more than timeout time has
-// elapsed since the start of pollWithContext, ErrTimeout is returned.
-func pollWithContext(ctx context.Context, timeout time.Duration, pollFn func() (success bool, err error)) error {
-	start := time.Now()
+// lockVariable is the key of the workspace variable used as advisory lock. It
+// is an environment variable, a Terraform variable would be an undeclared
+// input variable of every run of the workspace. Terraform ignores unknown
+// environment variables.
+const lockVariable = "TFE_RUN_LOCK"
 
-	for {
-		select {
-		case <-ctx.Done():
-			return context.Canceled
-		case <-time.After(500 * time.Millisecond):
-			success, err := pollFn()
-			if err != nil || success {
-				return err
+// AcquireLock blocks until it holds the advisory lock of the workspace on
+// behalf of owner. The lock is a workspace variable holding the owner, it is
+// only respected by other invocations of tfe-run. If the lock is held by
+// another owner for longer than timeout, ErrLockTimeout is returned. If
+// acquiring the lock fails after it was created, e.g. because ctx was
+// canceled, it is released again.
+func (c *Client) AcquireLock(ctx context.Context, owner string, timeout time.Duration) (err error) {
+	var holder string
+	var created bool
+	defer func() {
+		if err != nil && created {
+			// ctx may be canceled already
+			releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+			defer cancel()
+			releaseErr := c.ReleaseLock(releaseCtx, owner)
+			if releaseErr != nil {
+				gha.Warningf("%v", releaseErr)
 			}
+		}
+	}()
 
-			if time.Since(start) > timeout {
-				return ErrTimeout
+	err = pollWithContext(ctx, timeout, func() (bool, error) {
+		v, err := c.lockVariable(ctx)
+		if err != nil {
+			return false, err
+		}
+		if v != nil {
+			if holder != v.Value {
+				holder = v.Value
+				fmt.Printf("Workspace is locked by %v, waiting...\n", holder)
 			}
+			return v.Value == owner, nil
+		}
+
+		_, err = c.client.Variables.Create(ctx, c.workspace.ID, tfe.VariableCreateOptions{
+			Key:         tfe.String(lockVariable),
+			Value:       tfe.String(owner),
+			Description: tfe.String("Advisory lock held by tfe-run, delete it to release a stale lock."),
+			Category:    tfe.Category(tfe.CategoryEnv),
+		})
+		if isConflict(err) {
+			// Another invocation created the lock in the meantime
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not create lock variable: %w", err)
 		}
+		created = true
+		return false, nil
+	})
+	if errors.Is(err, ErrTimeout) {
+		return fmt.Errorf("%w, held by %v", ErrLockTimeout, holder)
+	}
+	if err != nil {
+		return fmt.Errorf("could not acquire lock: %w", err)
 	}
+	fmt.Printf("Acquired lock on workspace %v\n", c.workspace.Name)
+	return nil
 }
 
-func main() {
-	var input input
-	var err error
-
-	if !gha.InGitHubActions() {
-		exitWithError(errors.New("tfe-run should only be run within GitHub Actions"))
+// ReleaseLock releases the advisory lock of the workspace if it is held by
+// owner.
+func (c *Client) ReleaseLock(ctx context.Context, owner string) error {
+	v, err := c.lockVariable(ctx)
+	if err != nil {
+		return fmt.Errorf("could not release lock: %w", err)
 	}
-
-	err = gha.PopulateFromInputs(&input)
+	if v == nil || v.Value != owner {
+		return nil
+	}
+	err = c.client.Variables.Delete(ctx, c.workspace.ID, v.ID)
 	if err != nil {
-		exitWithError(fmt.Errorf("could not read inputs: %w", err))
+		return fmt.Errorf("could not release lock: %w", err)
+	}
+	fmt.Printf("Released lock on workspace %v\n", c.workspace.Name)
+	return nil
+}
+
+// lockVariable returns the variable used as advisory lock, or nil if the
+// workspace is not locked.
+func (c *Client) lockVariable(ctx context.Context) (*tfe.Variable, error) {
+	options := &tfe.VariableListOptions{}
+	for {
+		vs, err := c.client.Variables.List(ctx, c.workspace.ID, options)
+		if err != nil {
+			return nil, fmt.Errorf("could not list variables: %w", err)
+		}
+		for _, v := range vs.Items {
+			if v.Key == lockVariable && v.Category == tfe.CategoryEnv {
+				return v, nil
+			}
+		}
+		if vs.Pagination == nil || vs.Pagination.NextPage == 0 {
+			return nil, nil
+		}
+		options.PageNumber = vs.Pagination.NextPage
+	}
+}
+
+// isConflict indicates whether err is the validation error of the API for a
+// variable key that is already taken.
+func isConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "has already been taken")
+}
+
+// queueDepth returns the number of runs ahead of runID in the run queue of the
+// organization. Reading the queue requires more permissions than queueing a
+// run, so failures are only logged and nil is returned. nil is also returned
+// if the run is not in the first page of the queue, e.g. because it already
+// started.
+func (c *Client) queueDepth(ctx context.Context, runID string) *int {
+	queue, err := c.client.Organizations.ReadRunQueue(ctx, c.workspace.Organization.Name, tfe.ReadRunQueueOptions{
+		ListOptions: tfe.ListOptions{PageSize: 100},
+	})
+	if err != nil {
+		gha.Debugf("Could not read run queue: %v", err)
+		return nil
+	}
+
+	for depth, r := range queue.Items {
+		if r.ID == runID {
+			return &depth
+		}
+	}
+	gha.Debugf("Run %v is not in the run queue", runID)
+	return nil
+}
+
+// createdBy returns the username of the user that created the run. Failures
+// are only logged, the creator is informational.
+func (c *Client) createdBy(ctx context.Context, runID string) string {
+	r, err := c.client.Runs.ReadWithOptions(ctx, runID, &tfe.RunReadOptions{
+		Include: []tfe.RunIncludeOpt{tfe.RunCreatedBy},
+	})
+	if err != nil {
+		gha.Debugf("Could not read creator of run: %v", err)
+		return ""
+	}
+	if r.CreatedBy == nil {
+		return ""
+	}
+	return r.CreatedBy.Username
+}
+
+// runState is persisted to RunOptions.StateFile.
+type runState struct {
+	WorkspaceID string `json:"workspace_id"`
+	RunID       string `json:"run_id"`
+	// GITHUB_RUN_ID and GITHUB_RUN_ATTEMPT of the workflow run that created
+	// the run.
+	WorkflowRunID      string `json:"workflow_run_id,omitempty"`
+	WorkflowRunAttempt string `json:"workflow_run_attempt,omitempty"`
+}
+
+// readRunState returns the ID of the run stored in the state file at path, or
+// the empty string if there is no state file, it belongs to another workspace
+// or workflow run attempt, or the run has already finished.
+func (c *Client) readRunState(ctx context.Context, path string) (string, error) {
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read state file: %w", err)
+	}
+
+	var state runState
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		return "", fmt.Errorf("could not parse state file: %w", err)
+	}
+	if state.WorkspaceID != c.workspace.ID ||
+		state.WorkflowRunID != os.Getenv("GITHUB_RUN_ID") ||
+		state.WorkflowRunAttempt != os.Getenv("GITHUB_RUN_ATTEMPT") {
+		return "", nil
+	}
+
+	r, err := c.client.Runs.Read(ctx, state.RunID)
+	if err != nil {
+		return "", fmt.Errorf("could not read run from state file: %w", err)
+	}
+	if isEndStatus(r.Status) {
+		fmt.Printf("Run %v in state file %v has already finished, creating a new run\n", r.ID, path)
+		return "", nil
+	}
+	fmt.Printf("Found run %v in state file %v\n", state.RunID, path)
+	return state.RunID, nil
+}
+
+// writeRunState writes runID to the state file at path.
+func (c *Client) writeRunState(path, runID string) error {
+	bytes, err := json.Marshal(runState{
+		WorkspaceID:        c.workspace.ID,
+		RunID:              runID,
+		WorkflowRunID:      os.Getenv("GITHUB_RUN_ID"),
+		WorkflowRunAttempt: os.Getenv("GITHUB_RUN_ATTEMPT"),
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal state file: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory for state file: %w", err)
+	}
+	err = os.WriteFile(path, bytes, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+	return nil
+}
+
+// removeRunState removes the state file at path once its run has finished.
+// Failures are only logged, a finished run is not resumed anyway.
+func removeRunState(path string) {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		gha.Warningf("could not remove state file: %v", err)
+	}
+}
+
+// confirmRun applies the planned run with runID, see StageApply.
+func (c *Client) confirmRun(ctx context.Context, runID string) (*tfe.Run, error) {
+	if runID == "" {
+		return nil, errors.New("the ID of the run to apply is required for stage apply")
+	}
+	r, err := c.client.Runs.Read(ctx, runID)
+	if err != nil {
+		return nil, fmt.Errorf("could not read run: %w", err)
+	}
+	if !isConfirmable(r) {
+		return nil, fmt.Errorf("run %v can not be applied, its status is %v", r.ID, c.prettyPrint(r.Status))
+	}
+
+	err = c.client.Runs.Apply(ctx, r.ID, tfe.RunApplyOptions{
+		Comment: tfe.String("Applied by tfe-run"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not apply run %v: %w", r.ID, err)
+	}
+	return r, nil
+}
+
+// isConfirmable returns whether r is planned and awaits confirmation.
+func isConfirmable(r *tfe.Run) bool {
+	return r.Actions != nil && r.Actions.IsConfirmable
+}
+
+// activeRun returns the current run of the workspace, if it is not finished yet.
+func (c *Client) activeRun(ctx context.Context) (*tfe.Run, error) {
+	w, err := c.client.Workspaces.ReadByID(ctx, c.workspace.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not read workspace: %w", err)
+	}
+	if w.CurrentRun == nil {
+		return nil, ErrNoActiveRun
+	}
+
+	r, err := c.client.Runs.Read(ctx, w.CurrentRun.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not read run: %w", err)
+	}
+	if isEndStatus(r.Status) {
+		return nil, fmt.Errorf("%w, current run %v is already %v", ErrNoActiveRun, r.ID, c.prettyPrint(r.Status))
+	}
+	return r, nil
+}
+
+func (c *Client) createRun(ctx context.Context, options RunOptions) (*tfe.Run, error) {
+	if c.OptionsMutator != nil {
+		c.OptionsMutator(&options)
+	}
+
+	if options.Type == RunTypeDestroy && options.RequireTargetsForDestroy && len(options.TargetAddrs) == 0 {
+		return nil, ErrUntargetedDestroy
+	}
+
+	if options.ValidateTargetsAgainstState && len(options.TargetAddrs) > 0 {
+		err := c.validateTargets(ctx, options.TargetAddrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var cv *tfe.ConfigurationVersion
+	if options.ConfigurationVersion != "" {
+		var err error
+		cv, err = c.resolveConfigurationVersion(ctx, options.ConfigurationVersion)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Running against configuration version %v\n", cv.ID)
+	}
+
+	rOptions := tfe.RunCreateOptions{
+		Workspace:            c.workspace,
+		ConfigurationVersion: cv,
+		IsDestroy:            tfe.Bool(options.Type == RunTypeDestroy),
+		TargetAddrs:          dedupe("target", options.TargetAddrs),
+		ReplaceAddrs:         dedupe("replace", options.ReplaceAddrs),
+		Message:              reasonMessage(options.Reason, options.Message),
+	}
+	if options.Type == RunTypePlan {
+		// Speculative, otherwise the run would still be applied on
+		// workspaces with auto apply
+		rOptions.PlanOnly = tfe.Bool(true)
+	}
+	if options.Stage == StagePlan {
+		rOptions.AutoApply = tfe.Bool(false)
+	}
+	r, err := c.client.Runs.Create(ctx, rOptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not create run: %w", err)
+	}
+
+	for _, comment := range []*string{options.Description, options.Comment} {
+		if comment == nil {
+			continue
+		}
+		_, err = c.client.Comments.Create(ctx, r.ID, tfe.CommentCreateOptions{Body: *comment})
+		if err != nil {
+			return nil, fmt.Errorf("could not comment on run %v: %w", r.ID, err)
+		}
+	}
+	return r, nil
+}
+
+// resolveConfigurationVersion returns the most recent uploaded configuration
+// version of the workspace matching label. See RunOptions.ConfigurationVersion.
+func (c *Client) resolveConfigurationVersion(ctx context.Context, label string) (*tfe.ConfigurationVersion, error) {
+	options := &tfe.ConfigurationVersionListOptions{
+		Include: []tfe.ConfigVerIncludeOpt{tfe.ConfigVerIngressAttributes},
+	}
+	for {
+		cvs, err := c.client.ConfigurationVersions.List(ctx, c.workspace.ID, options)
+		if err != nil {
+			return nil, fmt.Errorf("could not list configuration versions: %w", err)
+		}
+		for _, cv := range cvs.Items {
+			if cv.Status == tfe.ConfigurationUploaded && matchesLabel(cv, label) {
+				return cv, nil
+			}
+		}
+		if cvs.Pagination == nil || cvs.Pagination.NextPage == 0 {
+			break
+		}
+		options.PageNumber = cvs.Pagination.NextPage
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNoConfigurationVersion, label)
+}
+
+// matchesLabel returns whether cv has the ID or VCS tag label, or whether
+// label is (a prefix of) its commit SHA.
+func matchesLabel(cv *tfe.ConfigurationVersion, label string) bool {
+	if cv.ID == label {
+		return true
+	}
+	ia := cv.IngressAttributes
+	if ia == nil {
+		return false
+	}
+	return ia.Tag == label || (ia.CommitSHA != "" && strings.HasPrefix(ia.CommitSHA, label))
+}
+
+// reasonMessage prepends reason in brackets to message.
+func reasonMessage(reason string, message *string) *string {
+	if reason == "" {
+		return message
+	}
+	if message == nil {
+		return tfe.String(fmt.Sprintf("[%v]", reason))
+	}
+	return tfe.String(fmt.Sprintf("[%v] %v", reason, *message))
+}
+
+// dedupe returns addrs without duplicate entries, preserving the order in which
+// addresses first appear. kind is only used to log removed duplicates.
+func dedupe(kind string, addrs []string) []string {
+	if addrs == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(addrs))
+	deduped := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if seen[addr] {
+			gha.Debugf("Removing duplicate %v address %v", kind, addr)
+			continue
+		}
+		seen[addr] = true
+		deduped = append(deduped, addr)
+	}
+	return deduped
+}
+
+// reportPolicyChecks prints the results of the policy checks of the run and
+// adds a warning for every check with failed policies.
+func (c *Client) reportPolicyChecks(ctx context.Context, runID string) error {
+	pcs, err := c.client.PolicyChecks.List(ctx, runID, nil)
+	if err != nil {
+		return fmt.Errorf("could not list policy checks: %w", err)
+	}
+
+	fmt.Println("Policy checks:")
+	for _, pc := range pcs.Items {
+		if pc.Result == nil {
+			fmt.Printf(" - %v: %v\n", pc.ID, c.prettyPrint(tfe.RunStatus(pc.Status)))
+			continue
+		}
+		fmt.Printf(" - %v: %v passed, %v advisory failed, %v soft failed, %v hard failed\n",
+			pc.ID, pc.Result.Passed, pc.Result.AdvisoryFailed, pc.Result.SoftFailed, pc.Result.HardFailed)
+		if pc.Result.TotalFailed > 0 {
+			gha.Warningf("Policy check %v failed %v policies (%v soft failed)", pc.ID, pc.Result.TotalFailed, pc.Result.SoftFailed)
+		}
+	}
+	return nil
+}
+
+// policyOverrideRequired indicates whether r required a policy override,
+// either by its status or the status of its policy checks. Failures to list
+// the policy checks are only logged.
+func (c *Client) policyOverrideRequired(ctx context.Context, r *tfe.Run) bool {
+	switch r.Status {
+	case tfe.RunPolicyOverride, tfe.RunPolicySoftFailed:
+		return true
+	}
+	if len(r.PolicyChecks) == 0 {
+		return false
+	}
+
+	pcs, err := c.client.PolicyChecks.List(ctx, r.ID, nil)
+	if err != nil {
+		gha.Debugf("Could not list policy checks: %v", err)
+		return false
+	}
+	for _, pc := range pcs.Items {
+		if pc.Status == tfe.PolicySoftFailed || pc.Status == tfe.PolicyOverridden {
+			return true
+		}
+	}
+	return false
+}
+
+// overridePolicyChecks overrides the overridable policy checks of the run.
+func (c *Client) overridePolicyChecks(ctx context.Context, runID string) error {
+	pcs, err := c.client.PolicyChecks.List(ctx, runID, nil)
+	if err != nil {
+		return fmt.Errorf("could not list policy checks: %w", err)
+	}
+
+	var overridden int
+	for _, pc := range pcs.Items {
+		if pc.Actions == nil || !pc.Actions.IsOverridable {
+			continue
+		}
+		if pc.Permissions == nil || !pc.Permissions.CanOverride {
+			return fmt.Errorf("%w, the token may not override policy check %v", ErrPolicyOverrideRequired, pc.ID)
+		}
+		_, err = c.client.PolicyChecks.Override(ctx, pc.ID)
+		if err != nil {
+			return fmt.Errorf("could not override policy check %v: %w", pc.ID, err)
+		}
+		fmt.Printf("Policy check %v has been overridden\n", pc.ID)
+		overridden++
+	}
+	if overridden == 0 {
+		return fmt.Errorf("%w, run %v has no policy check that can be overridden", ErrPolicyOverrideRequired, runID)
+	}
+	return nil
+}
+
+// waitForTaskStage blocks until the task stages of the given stage are no
+// longer pending or running. Runs do not change status while post-apply tasks
+// are running, so the stages have to be polled instead.
+func (c *Client) waitForTaskStage(ctx context.Context, runID string, stage tfe.Stage, timeout time.Duration) error {
+	err := pollWithContext(ctx, timeout, func() (bool, error) {
+		stages, err := c.client.TaskStages.List(ctx, runID, nil)
+		if err != nil {
+			return false, fmt.Errorf("could not list task stages: %w", err)
+		}
+		for _, ts := range stages.Items {
+			if ts.Stage == stage && (ts.Status == tfe.TaskStagePending || ts.Status == tfe.TaskStageRunning) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for %v run tasks failed: %w", c.prettyPrint(tfe.RunStatus(stage)), err)
+	}
+	return nil
+}
+
+// checkTaskStage prints the results of the run tasks of the given stage. If a
+// mandatory task did not pass, an error is returned.
+func (c *Client) checkTaskStage(ctx context.Context, runID string, stage tfe.Stage) ([]*tfe.TaskResult, error) {
+	stages, err := c.client.TaskStages.List(ctx, runID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not list task stages: %w", err)
+	}
+
+	var results []*tfe.TaskResult
+	for _, ts := range stages.Items {
+		if ts.Stage != stage {
+			continue
+		}
+		ts, err = c.client.TaskStages.Read(ctx, ts.ID, &tfe.TaskStageReadOptions{
+			Include: []tfe.TaskStageIncludeOpt{tfe.TaskStageTaskResults},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not read task stage: %w", err)
+		}
+		results = append(results, ts.TaskResults...)
+	}
+
+	if len(results) == 0 {
+		return results, nil
+	}
+
+	fmt.Printf("Run tasks (%v):\n", c.prettyPrint(tfe.RunStatus(stage)))
+	var failed []string
+	for _, tr := range results {
+		fmt.Printf(" - %v: %v (%v)\n", tr.TaskName, tr.Status, tr.WorkspaceTaskEnforcementLevel)
+		if tr.Message != "" {
+			fmt.Printf("   %v\n", tr.Message)
+		}
+		if tr.Status != tfe.TaskPassed && tr.WorkspaceTaskEnforcementLevel == tfe.Mandatory {
+			if tr.Message != "" {
+				failed = append(failed, fmt.Sprintf("%v (%v)", tr.TaskName, tr.Message))
+				continue
+			}
+			failed = append(failed, tr.TaskName)
+		}
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("mandatory %v run tasks did not pass: %v", c.prettyPrint(tfe.RunStatus(stage)), strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+// changedResources returns the addresses of all resources the plan changes.
+func (p *planJSON) changedResources() []string {
+	changed := []string{}
+	for _, rc := range p.ResourceChanges {
+		if rc.isChange() {
+			changed = append(changed, rc.Address)
+		}
+	}
+	return changed
+}
+
+// checkPlan verifies the finished plan of r against the restrictions in
+// options. If the plan is rejected, the run is discarded when possible.
+func (c *Client) checkPlan(ctx context.Context, r *tfe.Run, options RunOptions) error {
+	raw, plan, err := c.readPlanJSON(ctx, r.Plan.ID)
+	if err != nil {
+		return err
+	}
+	if options.MaxPlanBytes > 0 && len(raw) > options.MaxPlanBytes {
+		return c.discard(ctx, r, fmt.Sprintf("JSON plan is %v bytes, more than the limit of %v bytes, reduce the size of the plan with targets or split the workspace", len(raw), options.MaxPlanBytes))
+	}
+
+	var outOfScope, blocked []string
+	for _, rc := range plan.ResourceChanges {
+		if len(options.AllowedModulePrefixes) > 0 && rc.isChange() && !isWithinAny(rc.Address, options.AllowedModulePrefixes) {
+			outOfScope = append(outOfScope, rc.Address)
+		}
+		if rc.isDelete() && slices.ContainsFunc(options.BlockReplacementsOf, func(target string) bool {
+			return containsAddress([]string{rc.Address}, target)
+		}) {
+			blocked = append(blocked, fmt.Sprintf("%v (%v)", rc.Address, strings.Join(rc.Change.Actions, ", ")))
+		}
+	}
+
+	var reasons []string
+	if len(outOfScope) > 0 {
+		reasons = append(reasons, fmt.Sprintf("plan changes resources outside of the allowed modules: %v", strings.Join(outOfScope, ", ")))
+	}
+	if len(blocked) > 0 {
+		reasons = append(reasons, fmt.Sprintf("plan replaces or destroys protected resources: %v", strings.Join(blocked, ", ")))
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return c.discard(ctx, r, strings.Join(reasons, "; "))
+}
+
+// cancel cancels r. Since this is called after the main context has been
+// canceled, a new short-lived context is used.
+func (c *Client) cancel(r *tfe.Run) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := c.client.Runs.Cancel(ctx, r.ID, tfe.RunCancelOptions{
+		Comment: tfe.String("Canceled by tfe-run: the action was interrupted"),
+	})
+	if err != nil {
+		fmt.Printf("Could not cancel run %v: %v\n", r.ID, err)
+		return
+	}
+	fmt.Printf("Run %v has been canceled\n", r.ID)
+}
+
+// recreateRun cancels r, which is stuck in the stage it is in, and creates a
+// new run with options instead.
+func (c *Client) recreateRun(ctx context.Context, r *tfe.Run, options RunOptions) (*tfe.Run, error) {
+	err := c.client.Runs.Cancel(ctx, r.ID, tfe.RunCancelOptions{
+		Comment: tfe.String(fmt.Sprintf("Canceled by tfe-run: the run was %v for more than %v", c.prettyPrint(r.Status), options.StuckStageTimeout)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not cancel stuck run: %w", err)
+	}
+	fmt.Printf("Run %v has been %v for more than %v, canceled it to recreate the run\n", r.ID, c.prettyPrint(r.Status), options.StuckStageTimeout)
+
+	created, err := c.createRun(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.StateFile != "" {
+		err = c.writeRunState(options.StateFile, created.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fmt.Printf("Run %v has been queued\n", created.ID)
+	fmt.Printf("%v\n", c.runURL(created.ID))
+	return created, nil
+}
+
+// setRunOutput sets the fields of output that describe run r itself, like its
+// ID and links.
+func (c *Client) setRunOutput(ctx context.Context, output *RunOutput, r *tfe.Run) {
+	output.RunID = r.ID
+	output.RunURL = c.runURL(r.ID)
+	output.CreatedBy = c.createdBy(ctx, r.ID)
+	output.PlanID, output.PlanURL, output.ApplyURL = "", "", ""
+	if r.Plan != nil {
+		output.PlanID = r.Plan.ID
+		output.PlanURL = fmt.Sprintf("%v/plans/%v", output.RunURL, r.Plan.ID)
+	}
+	if r.Apply != nil {
+		output.ApplyURL = fmt.Sprintf("%v/applies/%v", output.RunURL, r.Apply.ID)
+	}
+}
+
+// discardReason describes who or what discarded the run. This is best effort,
+// if the run events can not be read a generic description is returned.
+func (c *Client) discardReason(ctx context.Context, runID string) string {
+	events, err := c.client.RunEvents.List(ctx, runID, &tfe.RunEventListOptions{
+		Include: []tfe.RunEventIncludeOpt{tfe.RunEventActor, tfe.RunEventComment},
+	})
+	if err != nil {
+		gha.Debugf("Could not list run events: %v", err)
+		return "discarded"
+	}
+
+	var discarded *tfe.RunEvent
+	for _, e := range events.Items {
+		if e.Action == "discarded" {
+			discarded = e
+		}
+	}
+	if discarded == nil {
+		return "discarded"
+	}
+
+	var reason string
+	switch {
+	case discarded.Actor != nil && discarded.Actor.Username != "":
+		reason = fmt.Sprintf("discarded by %v", discarded.Actor.Username)
+	case discarded.Description != "":
+		reason = fmt.Sprintf("discarded: %v", discarded.Description)
+	default:
+		reason = "discarded automatically, it was probably superseded by a newer run"
+	}
+	if discarded.Comment != nil && discarded.Comment.Body != "" {
+		reason = fmt.Sprintf("%v with comment %q", reason, discarded.Comment.Body)
+	}
+	return reason
+}
+
+// discard discards r, if it can still be discarded, and returns an error with
+// the given reason.
+func (c *Client) discard(ctx context.Context, r *tfe.Run, reason string) error {
+	if r.Actions != nil && r.Actions.IsDiscardable {
+		err := c.client.Runs.Discard(ctx, r.ID, tfe.RunDiscardOptions{
+			Comment: tfe.String(fmt.Sprintf("Discarded by tfe-run: %v", reason)),
+		})
+		if err != nil {
+			return fmt.Errorf("%v, could not discard run: %w", reason, err)
+		}
+		fmt.Printf("Run %v has been discarded\n", r.ID)
+	}
+	return errors.New(reason)
+}
+
+// isWithinAny indicates whether addr is one of prefixes or within one of
+// them, see isWithin. A trailing dot of a prefix is ignored, e.g. module.app.
+// is the same as module.app.
+func isWithinAny(addr string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if isWithin(addr, strings.TrimSuffix(prefix, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPlanFinished reports whether the plan of a run with this status has
+// finished successfully.
+func isPlanFinished(r tfe.RunStatus) bool {
+	switch r {
+	case
+		tfe.RunPlanned,
+		tfe.RunCostEstimating,
+		tfe.RunCostEstimated,
+		tfe.RunPolicyChecking,
+		tfe.RunPolicyChecked,
+		tfe.RunPolicyOverride,
+		tfe.RunPolicySoftFailed,
+		tfe.RunPostPlanRunning,
+		tfe.RunPostPlanCompleted,
+		tfe.RunPostPlanAwaitingDecision,
+		tfe.RunPlannedAndFinished,
+		tfe.RunPlannedAndSaved,
+		tfe.RunConfirmed,
+		tfe.RunPreApplyRunning,
+		tfe.RunPreApplyCompleted,
+		tfe.RunQueuingApply,
+		tfe.RunApplyQueued,
+		tfe.RunApplying,
+		tfe.RunApplied:
+		return true
+	}
+	return false
+}
+
+// isQueued reports whether a run with this status has not started yet.
+func isQueued(r tfe.RunStatus) bool {
+	switch r {
+	case
+		tfe.RunPending,
+		tfe.RunQueuing,
+		tfe.RunPlanQueued:
+		return true
+	}
+	return false
+}
+
+// isPrePlan indicates whether the run is in one of the stages that have to
+// finish before it can be planned.
+func isPrePlan(r tfe.RunStatus) bool {
+	switch r {
+	case
+		tfe.RunFetching,
+		tfe.RunFetchingCompleted,
+		tfe.RunPrePlanRunning,
+		tfe.RunPrePlanCompleted:
+		return true
+	}
+	return false
+}
+
+// RunSkipped is the status Run reports for destroy runs that were discarded
+// because their plan destroys nothing, see RunOptions.SkipDestroyIfEmpty. It is
+// not a status of Terraform Cloud, which reports these runs as discarded.
+const RunSkipped tfe.RunStatus = "skipped"
+
+// isSucceeded indicates whether the run finished successfully. Runs that ended
+// with a soft failed policy check count as successful, Run only returns them
+// without error if that is allowed. Skipped destroy runs are successful no-ops.
+func isSucceeded(r tfe.RunStatus) bool {
+	switch r {
+	case
+		tfe.RunApplied,
+		tfe.RunPlannedAndFinished,
+		tfe.RunPolicySoftFailed,
+		RunSkipped:
+		return true
+	}
+	return false
+}
+
+func isEndStatus(r tfe.RunStatus) bool {
+	// Run statuses: https://pkg.go.dev/github.com/hashicorp/go-tfe?tab=doc#RunStatus
+	// Documentation: https://www.terraform.io/docs/cloud/api/run.html#run-states
+	switch r {
+	case
+		tfe.RunPolicySoftFailed,
+		tfe.RunPlannedAndFinished,
+		tfe.RunApplied,
+		tfe.RunDiscarded,
+		tfe.RunErrored,
+		tfe.RunCanceled:
+		return true
+	}
+	return false
+}
+
+// prettyPrint renders the status r, see Client.StatusMessages.
+func (c *Client) prettyPrint(r tfe.RunStatus) string {
+	if msg, ok := c.StatusMessages[r]; ok {
+		return msg
+	}
+	return prettyPrint(r)
+}
+
+func prettyPrint(r tfe.RunStatus) string {
+	return strings.ReplaceAll(string(r), "_", " ")
+}
+
+// planJSON is the subset of Terraform's JSON plan representation used by
+// tfe-run. For the full format, check https://developer.hashicorp.com/terraform/internals/json-format#plan-representation
+type planJSON struct {
+	FormatVersion   string           `json:"format_version"`
+	ResourceChanges []resourceChange `json:"resource_changes"`
+	// Changes to resources made outside of Terraform, detected while
+	// refreshing.
+	ResourceDrift []resourceChange `json:"resource_drift"`
+}
+
+type resourceChange struct {
+	Address       string `json:"address"`
+	ModuleAddress string `json:"module_address"`
+	Change        struct {
+		Actions []string `json:"actions"`
+	} `json:"change"`
+}
+
+// isDelete returns whether the change destroys the resource, either to replace
+// it or for good.
+func (rc resourceChange) isDelete() bool {
+	return slices.Contains(rc.Change.Actions, "delete")
+}
+
+// isChange reports whether applying the plan will modify this resource.
+func (rc resourceChange) isChange() bool {
+	for _, action := range rc.Change.Actions {
+		if action != "no-op" && action != "read" {
+			return true
+		}
+	}
+	return false
+}
+
+// readPlanJSON downloads the JSON execution plan of a finished plan.
+func (c *Client) readPlanJSON(ctx context.Context, planID string) ([]byte, *planJSON, error) {
+	bytes, err := c.client.Plans.ReadJSONOutput(ctx, planID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read JSON plan: %w", err)
+	}
+
+	var plan planJSON
+	err = json.Unmarshal(bytes, &plan)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse JSON plan: %w", err)
+	}
+	if plan.FormatVersion == "" {
+		return nil, nil, errors.New("JSON plan is missing format_version, is it a Terraform JSON plan?")
+	}
+	return bytes, &plan, nil
+}
+
+// WritePlanJSON writes the JSON execution plan to path. The file has the same
+// format as the output of `terraform show -json`, which is also the format
+// consumed by tools like Infracost.
+func (c *Client) WritePlanJSON(ctx context.Context, planID, path string) error {
+	bytes, _, err := c.readPlanJSON(ctx, planID)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory for JSON plan: %w", err)
+	}
+	err = os.WriteFile(path, bytes, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write JSON plan: %w", err)
+	}
+
+	fmt.Printf("JSON plan written to %v\n", path)
+	return nil
+}
+
+// Names of the files written by WriteArtifacts.
+const (
+	artifactPlanJSON     = "plan.json"
+	artifactPlanMarkdown = "plan.md"
+	artifactOutputsJSON  = "outputs.json"
+)
+
+// WriteArtifacts writes the JSON plan, a markdown summary of the plan and
+// outputsJSON into dir, so they can be uploaded as workflow artifacts. The
+// plan files are only written if the run has a plan.
+func (c *Client) WriteArtifacts(ctx context.Context, dir string, output RunOutput, outputsJSON string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create artifacts directory: %w", err)
+	}
+
+	if output.PlanID != "" {
+		bytes, plan, err := c.readPlanJSON(ctx, output.PlanID)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(dir, artifactPlanJSON), bytes, 0644)
+		if err != nil {
+			return fmt.Errorf("could not write JSON plan: %w", err)
+		}
+		markdown := planMarkdown(plan, c.Summary(output))
+		err = os.WriteFile(filepath.Join(dir, artifactPlanMarkdown), []byte(markdown), 0644)
+		if err != nil {
+			return fmt.Errorf("could not write plan markdown: %w", err)
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(dir, artifactOutputsJSON), []byte(outputsJSON), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write outputs: %w", err)
+	}
+
+	fmt.Printf("Artifacts written to %v\n", dir)
+	return nil
+}
+
+// planMarkdown renders the resource changes of plan as a markdown table below
+// summary.
+func planMarkdown(plan *planJSON, summary string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### %v\n\n", summary)
+
+	var rows []string
+	for _, rc := range plan.ResourceChanges {
+		if rc.isChange() {
+			rows = append(rows, fmt.Sprintf("| %v | `%v` |", strings.Join(rc.Change.Actions, ", "), rc.Address))
+		}
+	}
+	if len(rows) == 0 {
+		b.WriteString("No changes.\n")
+		return b.String()
+	}
+
+	b.WriteString("| Action | Resource |\n|---|---|\n")
+	for _, row := range rows {
+		b.WriteString(row + "\n")
+	}
+	return b.String()
+}
+
+// Diagnostic is a warning or error reported by Terraform.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	Detail   string `json:"detail"`
+	Address  string `json:"address"`
+}
+
+func (d Diagnostic) message() string {
+	msg := d.Detail
+	if msg == "" {
+		msg = d.Summary
+	}
+	if d.Address != "" {
+		msg = fmt.Sprintf("%v: %v", d.Address, msg)
+	}
+	return msg
+}
+
+// compactWarnings collapses diagnostics with the same summary into a single
+// diagnostic. The summary is prefixed with the number of occurrences and the
+// detail lists the affected addresses.
+func compactWarnings(ds []Diagnostic) []Diagnostic {
+	var order []string
+	grouped := make(map[string][]Diagnostic)
+	for _, d := range ds {
+		if _, ok := grouped[d.Summary]; !ok {
+			order = append(order, d.Summary)
+		}
+		grouped[d.Summary] = append(grouped[d.Summary], d)
+	}
+
+	compacted := make([]Diagnostic, 0, len(order))
+	for _, summary := range order {
+		group := grouped[summary]
+		if len(group) == 1 {
+			compacted = append(compacted, group[0])
+			continue
+		}
+
+		var addrs []string
+		for _, d := range group {
+			if d.Address != "" {
+				addrs = append(addrs, d.Address)
+			}
+		}
+		d := Diagnostic{
+			Severity: group[0].Severity,
+			Summary:  fmt.Sprintf("%d warnings: %v", len(group), summary),
+			Detail:   group[0].Detail,
+		}
+		if len(addrs) > 0 {
+			d.Detail = "Affected resources: " + strings.Join(addrs, ", ")
+		}
+		compacted = append(compacted, d)
+	}
+	return compacted
+}
+
+// logLine is a single line of Terraform's machine readable UI output. For the
+// full format, check https://developer.hashicorp.com/terraform/internals/machine-readable-ui
+type logLine struct {
+	Message    string      `json:"@message"`
+	Type       string      `json:"type"`
+	Diagnostic *Diagnostic `json:"diagnostic"`
+}
+
+// planLogTailLines is the number of lines of the plan log included in the
+// error of an errored speculative plan.
+const planLogTailLines = 20
+
+// planLogTail returns the last planLogTailLines lines of the plan logs, with
+// structured log lines reduced to their message. This is best effort, if the
+// logs can not be read an empty string is returned.
+func (c *Client) planLogTail(ctx context.Context, planID string) string {
+	logs, err := c.client.Plans.Logs(ctx, planID)
+	if err != nil {
+		gha.Debugf("Could not read plan logs: %v", err)
+		return ""
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		text := scanner.Text()
+		var line logLine
+		if json.Unmarshal(scanner.Bytes(), &line) == nil && line.Message != "" {
+			text = line.Message
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		lines = append(lines, text)
+		if len(lines) > planLogTailLines {
+			lines = lines[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		gha.Debugf("Could not read plan logs: %v", err)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// planWarnings returns the warning diagnostics from the plan logs. Lines that
+// are not structured log output are ignored.
+func (c *Client) planWarnings(ctx context.Context, planID string) ([]Diagnostic, error) {
+	logs, err := c.client.Plans.Logs(ctx, planID)
+	if err != nil {
+		return nil, fmt.Errorf("could not read plan logs: %w", err)
+	}
+
+	var warnings []Diagnostic
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		var line logLine
+		if json.Unmarshal(scanner.Bytes(), &line) != nil {
+			continue
+		}
+		if line.Type == "diagnostic" && line.Diagnostic != nil && line.Diagnostic.Severity == "warning" {
+			warnings = append(warnings, *line.Diagnostic)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read plan logs: %w", err)
+	}
+	return warnings, nil
+}
+
+type terraformOutput struct {
+	Value     interface{}     `json:"value"`
+	Type      json.RawMessage `json:"type"`
+	Sensitive bool            `json:"sensitive"`
+}
+
+type terraformResource struct {
+	Module    string `json:"module"`
+	Mode      string `json:"mode"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Instances []struct {
+		IndexKey interface{} `json:"index_key"`
+	} `json:"instances"`
+}
+
+// addresses returns the address of the resource followed by the addresses of
+// each of its instances.
+func (r terraformResource) addresses() []string {
+	addr := fmt.Sprintf("%v.%v", r.Type, r.Name)
+	if r.Mode == "data" {
+		addr = "data." + addr
+	}
+	if r.Module != "" {
+		addr = r.Module + "." + addr
+	}
+
+	addrs := []string{addr}
+	for _, i := range r.Instances {
+		switch key := i.IndexKey.(type) {
+		case string:
+			addrs = append(addrs, fmt.Sprintf("%v[%q]", addr, key))
+		case float64:
+			addrs = append(addrs, fmt.Sprintf("%v[%v]", addr, key))
+		}
+	}
+	return addrs
+}
+
+type minimalTerraformState struct {
+	Outputs   map[string]terraformOutput `json:"outputs"`
+	Resources []terraformResource        `json:"resources"`
+
+	// ID of the run that created the state version, if known.
+	runID string
+}
+
+func (c *Client) readCurrentState(ctx context.Context) (*minimalTerraformState, error) {
+	s, err := c.client.StateVersions.ReadCurrent(ctx, c.workspace.ID)
+	if errors.Is(err, tfe.ErrResourceNotFound) {
+		return nil, ErrNoState
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get current state: %w", err)
+	}
+
+	if state, ok := c.states[s.ID]; ok {
+		return state, nil
+	}
+
+	bytes, err := c.client.StateVersions.Download(ctx, s.DownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not download state: %w", err)
+	}
+
+	var state minimalTerraformState
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse state: %w", err)
+	}
+	if s.Run != nil {
+		state.runID = s.Run.ID
+	}
+	// Unprocessed state versions may still change
+	if s.ResourcesProcessed {
+		if c.states == nil {
+			c.states = map[string]*minimalTerraformState{}
+		}
+		c.states[s.ID] = &state
+	}
+	return &state, nil
+}
+
+// isStale returns whether the result of readCurrentState does not reflect the
+// apply of run runID yet.
+func isStale(state *minimalTerraformState, err error, runID string) bool {
+	if errors.Is(err, ErrNoState) {
+		return true
+	}
+	return err == nil && state.runID != "" && state.runID != runID
+}
+
+// waitForState blocks until the workspace has a current state version that has
+// been fully processed. If this takes longer than stateTimeout, ErrTimeout is
+// returned.
+func (c *Client) waitForState(ctx context.Context) error {
+	err := pollWithContext(ctx, stateTimeout, func() (bool, error) {
+		s, err := c.client.StateVersions.ReadCurrent(ctx, c.workspace.ID)
+		if errors.Is(err, tfe.ErrResourceNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not get current state: %w", err)
+		}
+		return s.ResourcesProcessed, nil
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for state failed: %w", err)
+	}
+	return nil
+}
+
+// validateTargets returns an error listing every target address that does not
+// match a resource, resource instance or module in the current state.
+func (c *Client) validateTargets(ctx context.Context, targets []string) error {
+	state, err := c.readCurrentState(ctx)
+	if err != nil {
+		return fmt.Errorf("could not validate targets: %w", err)
+	}
+
+	var stateAddrs []string
+	for _, r := range state.Resources {
+		stateAddrs = append(stateAddrs, r.addresses()...)
+	}
+
+	var missing []string
+	for _, target := range targets {
+		if !containsAddress(stateAddrs, target) {
+			missing = append(missing, target)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("target addresses not present in current state: %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// containsAddress reports whether target equals one of addrs or is a module or
+// resource that contains one of them.
+func containsAddress(addrs []string, target string) bool {
+	for _, addr := range addrs {
+		if isWithin(addr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithin indicates whether addr is target or an address within it, e.g.
+// module.app.null_resource.a or module.app["a"] are within module.app, but
+// module.application is not.
+func isWithin(addr, target string) bool {
+	return addr == target || strings.HasPrefix(addr, target+".") || strings.HasPrefix(addr, target+"[")
+}
+
+// OutputOptions groups all options available when reading outputs.
+type OutputOptions struct {
+	// Whether the outputs should be printed. Sensitive values are masked.
+	Print bool
+	// What to do when the workspace has no current state.
+	OnMissingState MissingStateBehavior
+	// Whether to wait until the current state version has been processed
+	// before reading outputs. Right after an apply, the outputs might not be
+	// available yet.
+	WaitForState bool
+	// Names of object outputs of which each attribute should also be returned
+	// as a separate output named <output>-<attribute>.
+	Flatten []string
+	// Names of outputs that must be present, otherwise an error listing the
+	// missing ones is returned. Flattened outputs can be required as well.
+	Required []string
+	// ID of the run that was just applied. If set, reading the state is
+	// retried a few times while the workspace has no state or the current
+	// state version was created by another run.
+	AppliedRunID string
+	// How often and in which interval to read the state after an apply, see
+	// AppliedRunID. Defaults to 5 attempts, 2s apart.
+	ReadAttempts int
+	ReadInterval time.Duration
+}
+
+// MissingStateBehavior describes how to handle a workspace without state.
+type MissingStateBehavior int
+
+// Declaration of missing state behaviors.
+const (
+	MissingStateWarn MissingStateBehavior = iota
+	MissingStateIgnore
+	MissingStateFail
+)
+
+// Check verifies that a run with the given options could be started, without
+// making any mutating calls. Access to the workspace has already been verified
+// when creating the Client, Check validates the permissions of the token and
+// the options referring to other resources.
+func (c *Client) Check(ctx context.Context, options RunOptions) error {
+	p := c.workspace.Permissions
+	if p == nil {
+		return errors.New("could not read the permissions of the token on the workspace")
+	}
+
+	var missing []string
+	if !p.CanQueueRun {
+		missing = append(missing, "queue runs")
+	}
+	if options.Type == RunTypeApply && !p.CanQueueApply {
+		missing = append(missing, "queue applies")
+	}
+	if options.Type == RunTypeDestroy && !p.CanQueueDestroy {
+		missing = append(missing, "queue destroy runs")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("token is not allowed to %v on workspace %v", strings.Join(missing, ", "), c.workspace.Name)
+	}
+
+	if options.ConfigurationVersion != "" {
+		_, err := c.resolveConfigurationVersion(ctx, options.ConfigurationVersion)
+		if err != nil {
+			return err
+		}
+	}
+	if options.ResumeRunID != "" {
+		_, err := c.client.Runs.Read(ctx, options.ResumeRunID)
+		if err != nil {
+			return fmt.Errorf("could not read run: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetWorkspaceSettings reads the effective settings of the workspace. The keys
+// of the returned map are the names of the settings, e.g. auto-apply.
+func (c *Client) GetWorkspaceSettings(ctx context.Context) (map[string]string, error) {
+	w, err := c.client.Workspaces.ReadByID(ctx, c.workspace.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not read workspace: %w", err)
+	}
+
+	settings := map[string]string{
+		"id":                     w.ID,
+		"auto-apply":             strconv.FormatBool(w.AutoApply),
+		"auto-apply-run-trigger": strconv.FormatBool(w.AutoApplyRunTrigger),
+		"terraform-version":      w.TerraformVersion,
+		"execution-mode":         w.ExecutionMode,
+		"working-directory":      w.WorkingDirectory,
+		"locked":                 strconv.FormatBool(w.Locked),
+	}
+	fmt.Println("Workspace settings:")
+	for _, k := range []string{"id", "auto-apply", "auto-apply-run-trigger", "terraform-version", "execution-mode", "working-directory", "locked"} {
+		fmt.Printf(" - %v: %v\n", k, settings[k])
+	}
+	return settings, nil
+}
+
+// AssessmentResult is the result of a health assessment of the workspace. The
+// API for assessment results is not covered by go-tfe.
+type AssessmentResult struct {
+	ID string `jsonapi:"primary,assessment-results"`
+	// Whether the assessment found resources that changed outside of
+	// Terraform.
+	Drifted bool `jsonapi:"attr,drifted"`
+	// Whether the assessment could be completed.
+	Succeeded    bool      `jsonapi:"attr,succeeded"`
+	ErrorMessage string    `jsonapi:"attr,error-msg"`
+	CreatedAt    time.Time `jsonapi:"attr,created-at,iso8601"`
+}
+
+// AssessmentOptions configures GetAssessmentResult.
+type AssessmentOptions struct {
+	// Whether ErrDriftDetected should be returned, along with the result, if
+	// the assessment detected drift.
+	FailOnDrift bool
+}
+
+// GetAssessmentResult reads the latest health assessment of the workspace.
+// Health assessments run independently of runs, on workspaces that have them
+// enabled. If the workspace has no assessment, ErrNoAssessment is returned.
+func (c *Client) GetAssessmentResult(ctx context.Context, options AssessmentOptions) (*AssessmentResult, error) {
+	req, err := c.client.NewRequest("GET", fmt.Sprintf("workspaces/%v/current-assessment-result", url.PathEscape(c.workspace.ID)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not read assessment result: %w", err)
+	}
+	result := &AssessmentResult{}
+	err = req.Do(ctx, result)
+	if errors.Is(err, tfe.ErrResourceNotFound) {
+		return nil, ErrNoAssessment
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read assessment result: %w", err)
+	}
+
+	switch {
+	case !result.Succeeded:
+		fmt.Printf("Assessment %v failed: %v\n", result.ID, result.ErrorMessage)
+	case result.Drifted:
+		fmt.Printf("Assessment %v detected drift\n", result.ID)
+	default:
+		fmt.Printf("Assessment %v found no drift\n", result.ID)
+	}
+	if options.FailOnDrift && result.Drifted {
+		return result, fmt.Errorf("%w, assessment %v from %v", ErrDriftDetected, result.ID, result.CreatedAt.Format(time.RFC3339))
+	}
+	return result, nil
+}
+
+// GetTerraformOutputs retrieves the outputs from the current Terraform state.
+//
+// If the workspace has no state yet, an empty map is returned unless
+// OutputOptions.OnMissingState is MissingStateFail.
+func (c *Client) GetTerraformOutputs(ctx context.Context, options OutputOptions) (map[string]string, error) {
+	state, err := c.readOutputs(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Outputs from current state:\n")
+	outputs := make(map[string]string)
+	// Iterate in sorted order, so the printed outputs are stable across runs
+	for _, k := range slices.Sorted(maps.Keys(state.Outputs)) {
+		v := state.Outputs[k]
+		// Marshal the value back into JSON
+		valueBytes, err := json.Marshal(v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Could not marshal value for key %s: %v", k, err)
+		}
+
+		// Convert the JSON byte array to a string
+		outputs[k] = string(valueBytes)
+
+		if options.Print {
+			var value string
+			if v.Sensitive {
+				value = "***"
+			} else {
+				value = outputs[k]
+			}
+			fmt.Printf(" - %v: %v\n", k, value)
+		}
+	}
+
+	for _, name := range options.Flatten {
+		err = flattenOutput(outputs, name, state.Outputs[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var missing []string
+	for _, name := range options.Required {
+		if _, ok := outputs[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("required outputs are missing: %v", strings.Join(missing, ", "))
+	}
+
+	return outputs, nil
+}
+
+// nativeOutput has the same format as an output in `terraform output -json`.
+type nativeOutput struct {
+	Sensitive bool            `json:"sensitive"`
+	Type      json.RawMessage `json:"type,omitempty"`
+	Value     interface{}     `json:"value"`
+}
+
+// GetTerraformOutputsJSON retrieves the outputs from the current Terraform
+// state in the same format as `terraform output -json`. Only
+// OutputOptions.WaitForState and OutputOptions.OnMissingState are used.
+func (c *Client) GetTerraformOutputsJSON(ctx context.Context, options OutputOptions) (string, error) {
+	state, err := c.readOutputs(ctx, options)
+	if err != nil {
+		return "", err
+	}
+
+	outputs := make(map[string]nativeOutput, len(state.Outputs))
+	for k, v := range state.Outputs {
+		outputs[k] = nativeOutput{Sensitive: v.Sensitive, Type: v.Type, Value: v.Value}
+	}
+
+	bytes, err := json.Marshal(outputs)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal outputs: %w", err)
+	}
+	return string(bytes), nil
+}
+
+// Result describes a finished run, it is written to the result file by
+// WriteResultFile.
+type Result struct {
+	RunID          string              `json:"run_id"`
+	RunURL         string              `json:"run_url"`
+	Status         tfe.RunStatus       `json:"status"`
+	HasChanges     *bool               `json:"has_changes,omitempty"`
+	ResourceCounts *ResourceCounts     `json:"resource_counts,omitempty"`
+	PolicyChecks   []ResultPolicyCheck `json:"policy_checks"`
+	Cost           *ResultCost         `json:"cost,omitempty"`
+	// Time between creating the run and its last status change.
+	DurationSeconds float64 `json:"duration_seconds"`
+	// Values of the outputs in the current state, sensitive values are
+	// replaced by "***".
+	Outputs map[string]json.RawMessage `json:"outputs"`
+	// Error the run failed with, only set for failure webhooks.
+	Error string `json:"error,omitempty"`
+}
+
+// ResultPolicyCheck holds the results of a policy check of the run.
+type ResultPolicyCheck struct {
+	ID             string           `json:"id"`
+	Status         tfe.PolicyStatus `json:"status"`
+	Passed         int              `json:"passed"`
+	AdvisoryFailed int              `json:"advisory_failed"`
+	SoftFailed     int              `json:"soft_failed"`
+	HardFailed     int              `json:"hard_failed"`
+}
+
+// ResultCost holds the cost estimate of the run.
+type ResultCost struct {
+	ProposedMonthlyCost string `json:"proposed_monthly_cost"`
+	DeltaMonthlyCost    string `json:"delta_monthly_cost"`
+}
+
+// WriteResultFile writes a Result describing the run of output as JSON to
+// path. Only OutputOptions.WaitForState is used, a missing state results in
+// no outputs.
+func (c *Client) WriteResultFile(ctx context.Context, path string, output RunOutput, options OutputOptions) error {
+	result, err := c.GetResult(ctx, output, options)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal result: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory for result file: %w", err)
+	}
+	err = os.WriteFile(path, bytes, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write result file: %w", err)
+	}
+
+	fmt.Printf("Result written to %v\n", path)
+	return nil
+}
+
+// GetResult returns a Result describing the run of output. Only
+// OutputOptions.WaitForState is used, a missing state results in no outputs.
+func (c *Client) GetResult(ctx context.Context, output RunOutput, options OutputOptions) (*Result, error) {
+	r, err := c.client.Runs.Read(ctx, output.RunID)
+	if err != nil {
+		return nil, fmt.Errorf("could not read run: %w", err)
+	}
+
+	result := Result{
+		RunID:           output.RunID,
+		RunURL:          output.RunURL,
+		Status:          r.Status,
+		HasChanges:      output.HasChanges,
+		ResourceCounts:  output.ResourceCounts,
+		PolicyChecks:    []ResultPolicyCheck{},
+		DurationSeconds: runDuration(r).Seconds(),
+		Outputs:         map[string]json.RawMessage{},
+	}
+	if output.Status == RunSkipped {
+		// Discarded by tfe-run itself
+		result.Status = RunSkipped
+	}
+
+	pcs, err := c.client.PolicyChecks.List(ctx, r.ID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not list policy checks: %w", err)
+	}
+	for _, pc := range pcs.Items {
+		rpc := ResultPolicyCheck{ID: pc.ID, Status: pc.Status}
+		if pc.Result != nil {
+			rpc.Passed = pc.Result.Passed
+			rpc.AdvisoryFailed = pc.Result.AdvisoryFailed
+			rpc.SoftFailed = pc.Result.SoftFailed
+			rpc.HardFailed = pc.Result.HardFailed
+		}
+		result.PolicyChecks = append(result.PolicyChecks, rpc)
+	}
+
+	if r.CostEstimate != nil {
+		ce, err := c.client.CostEstimates.Read(ctx, r.CostEstimate.ID)
+		if err != nil {
+			return nil, fmt.Errorf("could not read cost estimate: %w", err)
+		}
+		result.Cost = &ResultCost{ProposedMonthlyCost: ce.ProposedMonthlyCost, DeltaMonthlyCost: ce.DeltaMonthlyCost}
+	}
+
+	options.OnMissingState = MissingStateIgnore
+	state, err := c.readOutputs(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range state.Outputs {
+		value := []byte(`"***"`)
+		if !v.Sensitive {
+			value, err = json.Marshal(v.Value)
+			if err != nil {
+				return nil, fmt.Errorf("could not marshal value for key %v: %w", k, err)
+			}
+		}
+		result.Outputs[k] = value
+	}
+	return &result, nil
+}
+
+// WebhookOptions configures NotifyWebhook.
+type WebhookOptions struct {
+	// URL the result is posted to if the run succeeded.
+	SuccessURL string
+	// URL the result is posted to if the run failed.
+	FailureURL string
+	// How often and in which interval to post the result if the webhook
+	// fails with a network error or a 429 or 5xx status. Defaults to 3
+	// attempts, 2s apart.
+	Attempts int
+	Interval time.Duration
+	// Client used to post the result. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Options to read the outputs of the result with.
+	Outputs OutputOptions
+}
+
+// NotifyWebhook posts a Result describing the run of output as JSON to
+// WebhookOptions.SuccessURL, or to WebhookOptions.FailureURL if runErr is not
+// nil. Nothing is posted if the respective URL is empty, or to the success
+// webhook if the run has not finished successfully, e.g. when not waiting for
+// completion. For failures, the result only has the fields that could still
+// be read.
+func (c *Client) NotifyWebhook(ctx context.Context, options WebhookOptions, output RunOutput, runErr error) error {
+	webhookURL := options.SuccessURL
+	if runErr != nil {
+		webhookURL = options.FailureURL
+	}
+	if webhookURL == "" {
+		return nil
+	}
+	if runErr == nil && !isSucceeded(output.Status) {
+		gha.Debugf("Run has not finished successfully, not notifying the success webhook")
+		return nil
+	}
+
+	result := &Result{RunID: output.RunID, RunURL: output.RunURL, Status: output.Status}
+	if output.RunID != "" {
+		r, err := c.GetResult(ctx, output, options.Outputs)
+		switch {
+		case err == nil:
+			result = r
+		case runErr == nil:
+			return err
+		default:
+			gha.Debugf("Could not read result for failure webhook: %v", err)
+		}
+	}
+	if runErr != nil {
+		result.Error = runErr.Error()
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("could not marshal result: %w", err)
+	}
+
+	attempts, interval := options.Attempts, options.Interval
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+	if interval <= 0 {
+		interval = defaultWebhookInterval
+	}
+	httpClient := options.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhook(ctx, httpClient, webhookURL, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= attempts {
+			return fmt.Errorf("could not notify webhook: %w", err)
+		}
+		gha.Debugf("Webhook failed, retrying (attempt %v/%v): %v", attempt+1, attempts, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("could not notify webhook: %w", ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// postWebhook posts body to webhookURL. It returns whether a failed request
+// may succeed when retried.
+func postWebhook(ctx context.Context, httpClient *http.Client, webhookURL string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return false, nil
+}
+
+// runDuration returns the time between creating r and its last status change.
+func runDuration(r *tfe.Run) time.Duration {
+	if r.StatusTimestamps == nil || r.CreatedAt.IsZero() {
+		return 0
+	}
+	ts := r.StatusTimestamps
+	end := slices.MaxFunc([]time.Time{
+		ts.AppliedAt, ts.PlannedAndFinishedAt, ts.PolicySoftFailedAt,
+		ts.ErroredAt, ts.CanceledAt, ts.ForceCanceledAt, ts.DiscardedAt,
+	}, time.Time.Compare)
+	if end.IsZero() {
+		return 0
+	}
+	return end.Sub(r.CreatedAt)
+}
+
+// planQueueLatency returns the time between creating r and the start of its
+// plan, or nil if either is unknown.
+func planQueueLatency(r *tfe.Run) *time.Duration {
+	if r.StatusTimestamps == nil || r.CreatedAt.IsZero() || r.StatusTimestamps.PlanningAt.IsZero() {
+		return nil
+	}
+	latency := r.StatusTimestamps.PlanningAt.Sub(r.CreatedAt)
+	return &latency
+}
+
+// readOutputs reads the current state for its outputs. If the workspace has no
+// state, an empty state is returned unless OutputOptions.OnMissingState is
+// MissingStateFail.
+func (c *Client) readOutputs(ctx context.Context, options OutputOptions) (*minimalTerraformState, error) {
+	if options.WaitForState {
+		err := c.waitForState(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state, err := c.readCurrentState(ctx)
+	if options.AppliedRunID != "" {
+		attempts, interval := options.ReadAttempts, options.ReadInterval
+		if attempts <= 0 {
+			attempts = defaultReadAttempts
+		}
+		if interval <= 0 {
+			interval = defaultReadInterval
+		}
+		for attempt := 1; attempt < attempts && isStale(state, err, options.AppliedRunID); attempt++ {
+			gha.Debugf("State of run %v is not available yet, retrying (attempt %v/%v)", options.AppliedRunID, attempt+1, attempts)
+			err = sleepWithContext(ctx, interval)
+			if err != nil {
+				return nil, err
+			}
+			state, err = c.readCurrentState(ctx)
+		}
+		if err == nil && isStale(state, err, options.AppliedRunID) {
+			gha.Warningf("Current state version was not created by run %v, outputs might be outdated", options.AppliedRunID)
+		}
+	}
+	if errors.Is(err, ErrNoState) {
+		switch options.OnMissingState {
+		case MissingStateFail:
+			return nil, err
+		case MissingStateWarn:
+			gha.Warningf("Workspace %v has no state yet, no outputs are available", c.workspace.Name)
+		}
+		return &minimalTerraformState{}, nil
+	}
+	return state, err
+}
+
+// flattenOutput adds each attribute of the object output o to outputs, named
+// <name>-<attribute>.
+func flattenOutput(outputs map[string]string, name string, o terraformOutput) error {
+	object, ok := o.Value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("could not flatten output %v: not an object", name)
+	}
+
+	for k, v := range object {
+		valueBytes, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("could not marshal value for key %v of output %v: %w", k, name, err)
+		}
+		outputs[fmt.Sprintf("%v-%v", name, k)] = string(valueBytes)
+	}
+	return nil
+}
+
+var (
+	// ErrTimeout is returned when an operation timed out.
+	ErrTimeout = errors.New("timed out while polling")
+	// ErrQueueTimeout is returned when a run did not start in time. It wraps
+	// ErrTimeout.
+	ErrQueueTimeout = fmt.Errorf("%w, run did not leave the queue in time", ErrTimeout)
+	// ErrExecutionTimeout is returned when a run did not finish in time after
+	// it started. It wraps ErrTimeout.
+	ErrExecutionTimeout = fmt.Errorf("%w, run did not finish executing in time", ErrTimeout)
+	// ErrBranchNotAllowed is returned when confirming a planned run on a
+	// branch that is not listed in apply-branches.
+	ErrBranchNotAllowed = errors.New("applies are not allowed on this branch, it is not listed in apply-branches")
+	// ErrStuckStage is returned when a run is stuck in a stage before planning
+	// and can not be recreated, because it is an existing run or was already
+	// recreated once.
+	ErrStuckStage = errors.New("run is stuck")
+	// ErrMaxPolls is returned when a run did not finish within
+	// RunOptions.MaxPolls polls.
+	ErrMaxPolls = errors.New("gave up after the maximum number of polls")
+	// ErrPolicyOverrideRequired is returned when a run awaits a policy
+	// override that is not done by tfe-run, see RunOptions.OnPolicyOverride.
+	ErrPolicyOverrideRequired = errors.New("failed policies must be overridden")
+	// ErrNoAssessment is returned when the workspace has no health
+	// assessment.
+	ErrNoAssessment = errors.New("workspace has no assessment result, are health assessments enabled?")
+	// ErrDriftDetected is returned when the health assessment of the
+	// workspace detected drift and AssessmentOptions.FailOnDrift is set.
+	ErrDriftDetected = errors.New("health assessment detected drift")
+	// ErrUntargetedDestroy is returned when a destroy run has no targets and
+	// RunOptions.RequireTargetsForDestroy is set.
+	ErrUntargetedDestroy = errors.New("destroy runs require at least one target")
+	// ErrEmptyApply is returned when an apply run has no changes and
+	// RunOptions.OnEmptyApply is EmptyApplyFail.
+	ErrEmptyApply = errors.New("plan has no changes to apply")
+	// ErrInvalidToken is returned when the token is rejected by the API.
+	ErrInvalidToken = errors.New("token is not valid, it must be a user or team API token")
+	// ErrNoActiveRun is returned when attaching to a workspace without an
+	// active run.
+	ErrNoActiveRun = errors.New("workspace has no active run")
+	// ErrNoState is returned when the workspace has no current state.
+	ErrNoState = errors.New("workspace has no current state")
+	// ErrLockTimeout is returned when the advisory lock of the workspace could
+	// not be acquired in time. It wraps ErrTimeout.
+	ErrLockTimeout = fmt.Errorf("%w, workspace lock was not released in time", ErrTimeout)
+	// ErrPlanErrored is returned when the plan of a run errored.
+	ErrPlanErrored = errors.New("plan errored")
+	// ErrCostEstimationErrored is returned when the cost estimation of a run
+	// errored.
+	ErrCostEstimationErrored = errors.New("cost estimation errored")
+	// ErrApplyErrored is returned when the apply of a run errored.
+	ErrApplyErrored = errors.New("apply errored")
+	// ErrPartialApply is returned when the apply of a run errored after it
+	// changed resources, the state has changed. It wraps ErrApplyErrored.
+	ErrPartialApply = fmt.Errorf("%w, infrastructure has been partially changed", ErrApplyErrored)
+	// ErrNoConfigurationVersion is returned when no configuration version
+	// matches the given label.
+	ErrNoConfigurationVersion = errors.New("no uploaded configuration version matches label")
+)
+
+// defaultRunTimeout is the maximum time to wait for a run to complete if
+// RunOptions.Timeout is not set.
+const defaultRunTimeout = 60 * time.Minute
+
+// stateTimeout is the maximum time to wait for the state to be processed.
+var stateTimeout = 2 * time.Minute
+
+// defaultReadAttempts and defaultReadInterval bound how often the state is
+// read right after an apply if OutputOptions does not configure it.
+const (
+	defaultReadAttempts = 5
+	defaultReadInterval = 2 * time.Second
+)
+
+// defaultWorkspaceReadAttempts and defaultWorkspaceReadInterval bound how
+// often the organization and the workspace are read if ClientConfig does not
+// configure it.
+const (
+	defaultWorkspaceReadAttempts = 3
+	defaultWorkspaceReadInterval = time.Second
+)
+
+// defaultWebhookAttempts and defaultWebhookInterval bound how often a webhook
+// is retried if WebhookOptions does not configure it.
+const (
+	defaultWebhookAttempts = 3
+	defaultWebhookInterval = 2 * time.Second
+)
+
+// pollInterval is the time between two consecutive calls of pollFn.
+var pollInterval = 500 * time.Millisecond
+
+// sleepWithContext blocks for duration d, or until ctx is canceled.
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return context.Canceled
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// PollStrategy decides how long to wait between polls of a run.
+type PollStrategy interface {
+	// Next returns how long to sleep before the next poll, given the time
+	// elapsed since waiting started and the last known status of the run. If
+	// giveUp is set, waiting stops with ErrTimeout.
+	Next(elapsed time.Duration, status tfe.RunStatus) (sleep time.Duration, giveUp bool)
+}
+
+// FixedPollStrategy polls every Interval until Timeout has elapsed.
+type FixedPollStrategy struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Next implements PollStrategy.
+func (s FixedPollStrategy) Next(elapsed time.Duration, status tfe.RunStatus) (time.Duration, bool) {
+	return s.Interval, elapsed > s.Timeout
+}
+
+// BackoffPollStrategy polls with an interval that starts at Initial and grows
+// by Multiplier up to Max, until Timeout has elapsed. The last sleep is cut
+// short so the deadline is not overshot.
+type BackoffPollStrategy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Timeout    time.Duration
+}
+
+// Next implements PollStrategy.
+func (s BackoffPollStrategy) Next(elapsed time.Duration, status tfe.RunStatus) (time.Duration, bool) {
+	if elapsed > s.Timeout {
+		return 0, true
+	}
+	// Sleeping for elapsed*(Multiplier-1) grows the elapsed time, and so the
+	// interval, by Multiplier with every poll.
+	sleep := time.Duration(float64(elapsed) * (s.Multiplier - 1))
+	sleep = max(sleep, s.Initial)
+	if s.Max > 0 {
+		sleep = min(sleep, s.Max)
+	}
+	return min(sleep, s.Timeout-elapsed), false
+}
+
+// pollWithStrategy executes pollFn until it returns (true, nil) or (false,
+// err), sleeping between polls as decided by strategy. status returns the last
+// known status of the run.
+func pollWithStrategy(ctx context.Context, strategy PollStrategy, status func() tfe.RunStatus, pollFn func() (success bool, err error)) error {
+	start := time.Now()
+
+	for {
+		sleep, giveUp := strategy.Next(time.Since(start), status())
+		if giveUp {
+			return ErrTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return context.Canceled
+		case <-time.After(sleep):
+			success, err := pollFn()
+			if err != nil || success {
+				return err
+			}
+		}
+	}
+}
+
+// pollWithContext will execute pollFn every pollInterval until either
+// pollFn returns (true, nil) or (false, err). If more than timeout time has
+// elapsed since the start of pollWithContext, ErrTimeout is returned.
+func pollWithContext(ctx context.Context, timeout time.Duration, pollFn func() (success bool, err error)) error {
+	start := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Canceled
+		case <-time.After(pollInterval):
+			success, err := pollFn()
+			if err != nil || success {
+				return err
+			}
+
+			if time.Since(start) > timeout {
+				return ErrTimeout
+			}
+		}
+	}
+}
+
+// readInputs reads the inputs of the action, falling back to .tfe-run.yml and
+// the defaults of action.yaml. It also returns these defaults. GitHub Actions
+// sets the defaults itself, for GitLab CI and local runs they are set here.
+func readInputs(local bool) (in input, defaults map[string]string, err error) {
+	defaults, err = actionDefaults()
+	if err != nil {
+		return in, nil, err
+	}
+	if configFile := gha.FindConfigFile(os.Getenv("GITHUB_WORKSPACE")); configFile != "" {
+		err = gha.LoadConfigFile(configFile, defaults)
+		if err != nil {
+			return in, nil, err
+		}
+		fmt.Printf("Using defaults from %v\n", configFile)
+	}
+	if local || !gha.InGitHubActions() {
+		gha.SetDefaultInputs(defaults)
+	}
+
+	err = gha.PopulateFromInputs(&in)
+	if err != nil {
+		return in, nil, fmt.Errorf("could not read inputs: %w", err)
+	}
+	return in, defaults, nil
+}
+
+func main() {
+	var err error
+
+	envFile := flag.String("env-file", "", "dotenv file to read variables like INPUT_WORKSPACE from, for local runs")
+	flag.Parse()
+	if *envFile != "" {
+		err = gha.LoadEnvFile(*envFile)
+		if err != nil {
+			exitWithError(err)
+		}
+	}
+
+	if !gha.InCI() {
+		exitWithError(errors.New("tfe-run should only be run within GitHub Actions or GitLab CI"))
+	}
+
+	input, defaults, err := readInputs(*envFile != "")
+	if err != nil {
+		exitWithError(err)
+	}
+
+	defaulted, explicit := gha.DefaultedInputs(&input, defaults)
+	gha.Debugf("Inputs set explicitly: %v", strings.Join(explicit, ", "))
+	gha.Debugf("Inputs using their default: %v", strings.Join(defaulted, ", "))
+	if input.ReportDefaultedInputs {
+		defaultedInputs, _ := json.Marshal(defaulted)
+		gha.WriteOutput("defaulted-inputs", string(defaultedInputs))
 	}
 
 	runType := asRunType(input.Type)
+	runType = restrictToBranches(runType, nonEmptyLines(input.ApplyBranches), gha.GetMetadata().Ref)
+	stage := asStage(input.Stage)
+	err = checkApplyStage(stage, nonEmptyLines(input.ApplyBranches), gha.GetMetadata().Ref)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	settings, err := resolveSettings(input)
+	if err != nil {
+		exitWithError(err)
+	}
+	if runType == RunTypeDestroy && settings.RequireDestroyConfirmation && !input.ConfirmDestroy {
+		exitWithError(errors.New("destroy runs require confirmation, set confirm-destroy to true"))
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	token, err := resolveToken(input.Token, input.TokenFile)
+	if err != nil {
+		exitWithError(err)
+	}
+	gha.AddMask(token)
 
-	ctx := context.Background()
+	organization, err := resolveOrganization(input.Organization)
+	if err != nil {
+		exitWithError(err)
+	}
 
 	cfg := ClientConfig{
-		Token:        input.Token,
-		Organization: input.Organization,
-		Workspace:    input.Workspace,
+		Token:                 token,
+		Organization:          organization,
+		Workspace:             input.Workspace,
+		Address:               input.Address,
+		UIAddress:             input.UIAddress,
+		Proxy:                 input.Proxy,
+		WorkspaceReadAttempts: input.WorkspaceReadAttempts,
+		WorkspaceReadInterval: input.WorkspaceReadInterval,
 	}
 	c, err := NewClient(ctx, cfg)
 	if err != nil {
 		exitWithError(err)
 	}
 
+	if input.DumpWorkspaceSettings {
+		wsSettings, err := c.GetWorkspaceSettings(ctx)
+		if err != nil {
+			exitWithError(err)
+		}
+		for k, v := range wsSettings {
+			gha.WriteOutput(fmt.Sprintf("ws-%v", k), v)
+		}
+	}
+
+	if input.ReportAssessment || input.FailOnDrift {
+		assessment, err := c.GetAssessmentResult(ctx, AssessmentOptions{FailOnDrift: input.FailOnDrift})
+		if assessment != nil {
+			gha.WriteOutput("assessment-drifted", strconv.FormatBool(assessment.Drifted))
+			gha.WriteOutput("assessment-succeeded", strconv.FormatBool(assessment.Succeeded))
+		}
+		if errors.Is(err, ErrNoAssessment) && !input.FailOnDrift {
+			gha.Warningf("%v", err)
+		} else if err != nil {
+			exitWithError(err)
+		}
+	}
+
+	targetAddrs, err := parseAddrs(input.Targets, input.TargetsJSON)
+	if err != nil {
+		exitWithError(fmt.Errorf("could not parse targets-json: %w", err))
+	}
+	replaceAddrs, err := parseAddrs(input.Replacements, input.ReplacementsJSON)
+	if err != nil {
+		exitWithError(fmt.Errorf("could not parse replacements-json: %w", err))
+	}
+
+	metadata := gha.GetMetadata()
+	message, err := renderTemplate(input.Message, metadata)
+	if err != nil {
+		exitWithError(fmt.Errorf("could not render message: %w", err))
+	}
+	description, err := renderTemplate(input.Description, metadata)
+	if err != nil {
+		exitWithError(fmt.Errorf("could not render description: %w", err))
+	}
+
+	var comment *string
+	if input.AutoComment {
+		body, err := renderTemplate(autoCommentTemplate, metadata)
+		if err != nil {
+			exitWithError(fmt.Errorf("could not render comment: %w", err))
+		}
+		comment = &body
+	}
+
 	options := RunOptions{
-		Message:           notEmptyOrNil(input.Message),
-		Type:              runType,
-		TargetAddrs:       notAllEmptyOrNil(strings.Split(input.Targets, "\n")),
-		ReplaceAddrs:      notAllEmptyOrNil(strings.Split(input.Replacements, "\n")),
-		WaitForCompletion: input.WaitForCompletion,
+		Message:                     notEmptyOrNil(message),
+		Description:                 notEmptyOrNil(description),
+		Reason:                      input.Reason,
+		ConfigurationVersion:        input.ConfigurationVersion,
+		SoftFailPolicyIsSuccess:     input.SoftFailPolicyIsSuccess,
+		FireAndForget:               input.FireAndForget,
+		Type:                        runType,
+		TargetAddrs:                 targetAddrs,
+		ReplaceAddrs:                replaceAddrs,
+		Comment:                     comment,
+		WaitForCompletion:           input.WaitForCompletion,
+		Timeout:                     settings.Timeout,
+		QueueTimeout:                settings.QueueTimeout,
+		ExecutionTimeout:            settings.ExecutionTimeout,
+		StuckStageTimeout:           input.StuckStageTimeout,
+		InitialPollDelay:            input.InitialPollDelay,
+		ValidateTargetsAgainstState: input.ValidateTargetsAgainstState,
+		RequireTargetsForDestroy:    input.RequireTargetsForDestroy,
+		AllowedModulePrefixes:       nonEmptyLines(input.AllowedModulePrefixes),
+		BlockReplacementsOf:         nonEmptyLines(input.BlockReplacementsOf),
+		MaxPlanBytes:                input.MaxPlanBytes,
+		MaxPolls:                    input.MaxPolls,
+		SkipDestroyIfEmpty:          input.SkipDestroyIfEmpty,
+		ReportPrePlanTasks:          input.ReportPrePlanTasks,
+		WaitForPostApplyTasks:       input.WaitForPostApplyTasks,
+		ResumeRunID:                 input.ResumeRunID,
+		CancelOnInterrupt:           input.CancelOnInterrupt,
+		AnnotatePlanWarnings:        input.AnnotatePlanWarnings,
+		CompactWarnings:             input.CompactWarnings,
+		OnCancel:                    asCancelBehavior(input.OnCancel),
+		OnEmptyApply:                asEmptyApplyBehavior(input.OnEmptyApply),
+		OnPolicyOverride:            asPolicyOverrideBehavior(input.PolicyOverride),
+		Stage:                       stage,
+		ApplyRunID:                  input.ApplyRunID,
+		AttachLatest:                input.AttachLatest,
+		StateFile:                   input.StateFile,
+		PollStrategy:                asPollStrategy(input.PollStrategy, settings.Timeout),
 	}
-	output, err := c.Run(ctx, options)
+	if input.Check {
+		err = c.Check(ctx, options)
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println("Check passed, inputs are valid and the workspace is accessible.")
+		return
+	}
+
+	httpClient, err := newHTTPClient(input.Proxy)
 	if err != nil {
+		exitWithError(err)
+	}
+	var lockOwner string
+	if input.Lock {
+		lockOwner = newLockOwner()
+		err = c.AcquireLock(ctx, lockOwner, input.LockTimeout)
+		if err != nil {
+			exitWithError(err)
+		}
+	}
+	webhookOptions := WebhookOptions{
+		SuccessURL: input.SuccessWebhookURL,
+		FailureURL: input.FailureWebhookURL,
+		HTTPClient: httpClient,
+		Outputs:    OutputOptions{WaitForState: input.WaitForState},
+	}
+
+	output, err := c.Run(ctx, options)
+	if input.Lock {
+		// The run context may already be canceled, always clean up
+		releaseErr := c.ReleaseLock(context.Background(), lockOwner)
+		if releaseErr != nil {
+			gha.Warningf("%v", releaseErr)
+		}
+	}
+	// failRun reports a failure of the run or of handling its results, e.g.
+	// reading its outputs, and exits
+	failRun := func(err error) {
 		fmt.Printf("Error: %v\n", err)
+		if input.GitHubToken != "" && input.IssueRepo != "" {
+			reportIssue(httpClient, input.GitHubToken, input.IssueRepo, organization, input.Workspace, output, err)
+		}
+		notifyWebhook(c, webhookOptions, output, err)
 		os.Exit(1)
 	}
-
+	if err != nil {
+		failRun(err)
+	}
+	gha.WriteOutput("run-id", output.RunID)
 	gha.WriteOutput("run-url", output.RunURL)
+	gha.WriteOutput("reused-existing-run", strconv.FormatBool(output.ReusedExistingRun))
+	if output.CreatedBy != "" {
+		gha.WriteOutput("created-by", output.CreatedBy)
+	}
+	if output.PlanURL != "" {
+		gha.WriteOutput("plan-url", output.PlanURL)
+	}
+	if output.ApplyURL != "" {
+		gha.WriteOutput("apply-url", output.ApplyURL)
+	}
+	if options.FireAndForget {
+		return
+	}
+	if output.Status != "" {
+		c.writeStatusOutputs(output.Status)
+	}
 	if output.HasChanges != nil {
 		gha.WriteOutput("has-changes", strconv.FormatBool(*output.HasChanges))
 	}
+	if output.Applied != nil {
+		gha.WriteOutput("applied", strconv.FormatBool(*output.Applied))
+	}
+	if output.PolicyOverrideRequired != nil {
+		gha.WriteOutput("policy-override-required", strconv.FormatBool(*output.PolicyOverrideRequired))
+	}
+	gha.WriteOutput("summary", c.Summary(output))
+	if output.ResourceCounts != nil {
+		gha.WriteOutput("changes", output.ResourceCounts.String())
+	}
+	if output.DriftCount != nil {
+		gha.WriteOutput("drift-count", strconv.Itoa(*output.DriftCount))
+	}
+	if output.QueueDepth != nil {
+		gha.WriteOutput("queue-depth", strconv.Itoa(*output.QueueDepth))
+	}
+	if output.AppliedAt != nil {
+		gha.WriteOutput("applied-at", output.AppliedAt.Format(time.RFC3339))
+	}
+	if output.TerraformVersion != "" {
+		gha.WriteOutput("terraform-version", output.TerraformVersion)
+	}
+	if output.PlanQueueLatency != nil {
+		gha.WriteOutput("plan-queue-latency-seconds", strconv.Itoa(int(output.PlanQueueLatency.Round(time.Second).Seconds())))
+	}
+	if output.ChangedResources != nil {
+		changedResources, _ := json.Marshal(output.ChangedResources)
+		gha.WriteOutput("changed-resources", string(changedResources))
+	}
+
+	if output.Status == tfe.RunCanceled && options.OnCancel == CancelSkip {
+		return
+	}
 
-	outputs, err := c.GetTerraformOutputs(ctx, input.PrintOutputs)
+	if input.InfracostPlanPath != "" {
+		err = c.WritePlanJSON(ctx, output.PlanID, input.InfracostPlanPath)
+		if err != nil {
+			failRun(err)
+		}
+	}
+
+	outputOptions := OutputOptions{
+		Print:          input.PrintOutputs,
+		OnMissingState: asMissingStateBehavior(input.OnMissingState),
+		WaitForState:   input.WaitForState,
+		Flatten:        nonEmptyLines(input.FlattenOutputs),
+		Required:       nonEmptyLines(input.RequiredOutputs),
+		ReadAttempts:   input.OutputReadAttempts,
+		ReadInterval:   input.OutputReadInterval,
+	}
+	if output.Status == tfe.RunApplied {
+		outputOptions.AppliedRunID = output.RunID
+	}
+	outputs, err := c.GetTerraformOutputs(ctx, outputOptions)
 	if err != nil {
-		exitWithError(err)
+		failRun(err)
+	}
+
+	exported := exportedOutputs(outputs, nonEmptyLines(input.ExportOutputs))
+	for _, k := range slices.Sorted(maps.Keys(exported)) {
+		gha.WriteOutput(fmt.Sprintf("tf-%v", k), exported[k])
+	}
+
+	if input.ResultFile != "" {
+		err = c.WriteResultFile(ctx, input.ResultFile, output, outputOptions)
+		if err != nil {
+			failRun(err)
+		}
+	}
+
+	if input.NativeOutputs || input.ArtifactsDir != "" {
+		nativeOutputs, err := c.GetTerraformOutputsJSON(ctx, outputOptions)
+		if err != nil {
+			failRun(err)
+		}
+		if input.NativeOutputs {
+			gha.WriteOutput("tf-outputs-native", nativeOutputs)
+		}
+		if input.ArtifactsDir != "" {
+			err = c.WriteArtifacts(ctx, input.ArtifactsDir, output, nativeOutputs)
+			if err != nil {
+				failRun(err)
+			}
+		}
+	}
+
+	webhookOptions.Outputs = outputOptions
+	notifyWebhook(c, webhookOptions, output, nil)
+}
+
+//go:embed action.yaml
+var actionYAML []byte
+
+// actionDefaults returns the default values of the inputs declared in
+// action.yaml. GitHub Actions sets these for inputs that are not given, so
+// they may still be overridden by the config file.
+func actionDefaults() (map[string]string, error) {
+	var action struct {
+		Inputs map[string]struct {
+			Default string `yaml:"default"`
+		} `yaml:"inputs"`
+	}
+	err := yaml.Unmarshal(actionYAML, &action)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse action.yaml: %w", err)
+	}
+
+	defaults := map[string]string{}
+	for name, i := range action.Inputs {
+		defaults[name] = i.Default
+	}
+	return defaults, nil
+}
+
+// autoCommentTemplate is rendered with gha.Metadata to comment on runs.
+const autoCommentTemplate = `Queued by {{with .CI}}{{.}}{{else}}tfe-run{{end}}{{if .Actor}}, triggered by {{.Actor}}{{end}}.
+
+- Commit: {{.Repository}}@{{.Commit}}{{if .Ref}} ({{.Ref}}){{end}}
+{{- if .PullRequest.Number}}
+- Pull request: #{{.PullRequest.Number}} {{.PullRequest.Title}}{{if .PullRequest.Author}} by {{.PullRequest.Author}}{{end}}
+{{- end}}
+- Workflow: {{.Workflow}}
+- CI job: {{.JobURL}}`
+
+// failureIssueTemplate is rendered into the issue opened or commented on by
+// reportIssue.
+const failureIssueTemplate = `tfe-run failed{{if .Metadata.Workflow}} in workflow {{.Metadata.Workflow}}{{end}}.
+
+- Run: {{if .RunURL}}{{.RunURL}}{{else}}no run was created{{end}}
+- Commit: {{.Metadata.Repository}}@{{.Metadata.Commit}}
+- CI job: {{.Metadata.JobURL}}
+
+` + "```" + `
+{{.Error}}
+` + "```"
+
+// reportIssue opens an issue in repo for a failed run, or comments on the
+// issue if one is already open for the workspace. Requests are sent with
+// httpClient, i.e. through the proxy. Failing to do so is only logged as a
+// warning, the run itself has already failed.
+func reportIssue(httpClient *http.Client, token, repo, organization, workspace string, output RunOutput, runErr error) {
+	body, err := renderTemplate(failureIssueTemplate, map[string]interface{}{
+		"Metadata": gha.GetMetadata(),
+		"RunURL":   output.RunURL,
+		"Error":    runErr.Error(),
+	})
+	if err != nil {
+		gha.Warningf("could not render issue: %v", err)
+		return
+	}
+
+	// A fresh context, the run context may already be canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	title := fmt.Sprintf("tfe-run failed for workspace %v/%v", organization, workspace)
+	issueURL, err := gha.NewGitHub(token, httpClient).ReportIssue(ctx, repo, title, body)
+	if err != nil {
+		gha.Warningf("could not report failure to %v: %v", repo, err)
+		return
+	}
+	fmt.Printf("Reported failure in %v\n", issueURL)
+}
+
+// writeStatusOutputs writes the status of the run as returned by the API, e.g.
+// planned_and_finished, and as it is printed to the log.
+func (c *Client) writeStatusOutputs(status tfe.RunStatus) {
+	gha.WriteOutput("run-status", string(status))
+	gha.WriteOutput("run-status-pretty", c.prettyPrint(status))
+}
+
+// newLockOwner returns a unique owner of the advisory lock for this
+// invocation. The job URL is shared by all jobs of a workflow run, e.g. the
+// jobs of a matrix, so the job, run attempt and a random suffix are added.
+func newLockOwner() string {
+	owner := gha.GetMetadata().JobURL
+	if owner == "" {
+		owner = "tfe-run"
+	}
+	if job := os.Getenv("GITHUB_JOB"); job != "" {
+		owner += fmt.Sprintf(" (job %v, attempt %v)", job, os.Getenv("GITHUB_RUN_ATTEMPT"))
+	}
+
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return fmt.Sprintf("%v pid %v", owner, os.Getpid())
+	}
+	return fmt.Sprintf("%v %x", owner, suffix)
+}
+
+// notifyWebhook posts the result of the run to the success or failure webhook,
+// a failing webhook does not fail the action.
+func notifyWebhook(c *Client, options WebhookOptions, output RunOutput, runErr error) {
+	// A fresh context, the run context may already be canceled
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := c.NotifyWebhook(ctx, options, output, runErr)
+	if err != nil {
+		gha.Warningf("%v", err)
+	}
+}
+
+// renderTemplate executes the text/template text with data.
+func renderTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, data)
+	if err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// signalContext returns a context that is canceled when the process receives
+// SIGTERM or SIGINT. GitHub sends SIGTERM when a job is canceled.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+}
+
+// resolveToken returns the token read from tokenFile, with surrounding
+// whitespace trimmed, or the token input if tokenFile is empty.
+func resolveToken(input, tokenFile string) (string, error) {
+	if tokenFile == "" {
+		if input == "" {
+			return "", errors.New("token is required, set the token or token-file input")
+		}
+		return input, nil
 	}
 
-	for k, v := range outputs {
-		gha.WriteOutput(fmt.Sprintf("tf-%v", k), v)
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read token-file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token-file %v is empty", tokenFile)
+	}
+	return token, nil
+}
+
+// resolveOrganization returns the organization input or, if it is empty, the
+// value of the TFE_ORG or TF_ORGANIZATION environment variable.
+func resolveOrganization(input string) (string, error) {
+	if input != "" {
+		return input, nil
+	}
+	for _, key := range []string{"TFE_ORG", "TF_ORGANIZATION"} {
+		if org := os.Getenv(key); org != "" {
+			return org, nil
+		}
 	}
+	return "", errors.New("organization is required, set the organization input or the TFE_ORG environment variable")
 }
 
+// The as* functions parse the values of enum inputs, exiting on unsupported
+// values. The empty string selects the default declared in action.yaml.
 func asRunType(s string) RunType {
 	switch s {
-	case "apply":
+	case "", "apply":
 		return RunTypeApply
 	case "plan":
 		return RunTypePlan
@@ -352,6 +3551,123 @@ func asRunType(s string) RunType {
 	return 0
 }
 
+func asMissingStateBehavior(s string) MissingStateBehavior {
+	switch s {
+	case "", "warn":
+		return MissingStateWarn
+	case "ignore":
+		return MissingStateIgnore
+	case "fail":
+		return MissingStateFail
+	}
+	exitWithError(fmt.Errorf("on-missing-state \"%s\" is not supported, must be ignore, warn or fail", s))
+	return 0
+}
+
+// parseAddrs parses a list of addresses. If jsonList is set it must be a JSON
+// array of strings and takes precedence over lines, a newline separated list.
+func parseAddrs(lines, jsonList string) ([]string, error) {
+	if strings.TrimSpace(jsonList) == "" {
+		return notAllEmptyOrNil(strings.Split(lines, "\n")), nil
+	}
+
+	var addrs []string
+	err := json.Unmarshal([]byte(jsonList), &addrs)
+	if err != nil {
+		return nil, err
+	}
+	return notAllEmptyOrNil(addrs), nil
+}
+
+func asCancelBehavior(s string) CancelBehavior {
+	switch s {
+	case "", "fail":
+		return CancelFail
+	case "succeed":
+		return CancelSucceed
+	case "skip":
+		return CancelSkip
+	}
+	exitWithError(fmt.Errorf("on-cancel \"%s\" is not supported, must be fail, succeed or skip", s))
+	return 0
+}
+
+func asStage(s string) Stage {
+	switch s {
+	case "", "full":
+		return StageFull
+	case "plan":
+		return StagePlan
+	case "apply":
+		return StageApply
+	}
+	exitWithError(fmt.Errorf("stage \"%s\" is not supported, must be plan, apply or full", s))
+	return 0
+}
+
+func asPolicyOverrideBehavior(s string) PolicyOverrideBehavior {
+	switch s {
+	case "", "wait":
+		return PolicyOverrideWait
+	case "fail":
+		return PolicyOverrideFail
+	case "override":
+		return PolicyOverrideOverride
+	}
+	exitWithError(fmt.Errorf("policy-override \"%s\" is not supported, must be wait, fail or override", s))
+	return 0
+}
+
+func asEmptyApplyBehavior(s string) EmptyApplyBehavior {
+	switch s {
+	case "", "succeed":
+		return EmptyApplySucceed
+	case "warn":
+		return EmptyApplyWarn
+	case "fail":
+		return EmptyApplyFail
+	}
+	exitWithError(fmt.Errorf("on-empty-apply \"%s\" is not supported, must be succeed, warn or fail", s))
+	return 0
+}
+
+func asPollStrategy(s string, timeout time.Duration) PollStrategy {
+	switch s {
+	case "", "fixed":
+		return FixedPollStrategy{Interval: pollInterval, Timeout: timeout}
+	case "backoff":
+		return BackoffPollStrategy{Initial: pollInterval, Max: 30 * time.Second, Multiplier: 1.5, Timeout: timeout}
+	}
+	exitWithError(fmt.Errorf("poll-strategy \"%s\" is not supported, must be fixed or backoff", s))
+	return nil
+}
+
+// restrictToBranches downgrades an apply to a speculative plan if branches is
+// not empty and ref is not one of the branches.
+func restrictToBranches(runType RunType, branches []string, ref string) RunType {
+	if runType != RunTypeApply || isAllowedBranch(branches, ref) {
+		return runType
+	}
+	fmt.Printf("Branch %v is not listed in apply-branches, running a speculative plan instead of an apply.\n", strings.TrimPrefix(ref, "refs/heads/"))
+	return RunTypePlan
+}
+
+// checkApplyStage returns ErrBranchNotAllowed if stage confirms a planned run
+// on a branch that is not listed in branches. Unlike new runs, confirmed runs
+// can not be downgraded to a speculative plan.
+func checkApplyStage(stage Stage, branches []string, ref string) error {
+	if stage != StageApply || isAllowedBranch(branches, ref) {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrBranchNotAllowed, strings.TrimPrefix(ref, "refs/heads/"))
+}
+
+// isAllowedBranch indicates whether applies are allowed on ref, i.e. branches
+// is empty or lists its branch.
+func isAllowedBranch(branches []string, ref string) bool {
+	return len(branches) == 0 || slices.Contains(branches, strings.TrimPrefix(ref, "refs/heads/"))
+}
+
 func notEmptyOrNil(s string) *string {
 	if s == "" {
 		return nil
@@ -368,6 +3684,35 @@ func notAllEmptyOrNil(slice []string) []string {
 	return nil
 }
 
+// exportedOutputs returns the outputs whose name is in names, or all outputs
+// if names is empty. Flattened outputs are matched by their full name, e.g.
+// db-host.
+func exportedOutputs(outputs map[string]string, names []string) map[string]string {
+	if len(names) == 0 {
+		return outputs
+	}
+	exported := map[string]string{}
+	for _, name := range names {
+		if v, ok := outputs[name]; ok {
+			exported[name] = v
+		}
+	}
+	return exported
+}
+
+// nonEmptyLines splits s into lines, leaving out lines that are empty or only
+// contain whitespace.
+func nonEmptyLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func exitWithError(err error) {
 	fmt.Printf("Error: %v", err)
 	os.Exit(1)
@@ -0,0 +1,3074 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/danny02/tfe-run/gha"
+	tfe "github.com/hashicorp/go-tfe"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	pollInterval = time.Millisecond
+	os.Exit(m.Run())
+}
+
+// fakeRuns creates a single run, reads return the runs in reads one by one,
+// repeating the last one.
+type fakeRuns struct {
+	tfe.Runs
+	created   []tfe.RunCreateOptions
+	reads     []*tfe.Run
+	discarded []string
+	canceled  []string
+	readTimes []time.Time
+	createdBy *tfe.User
+	applied   []string
+}
+
+func (f *fakeRuns) Create(ctx context.Context, options tfe.RunCreateOptions) (*tfe.Run, error) {
+	f.created = append(f.created, options)
+	return &tfe.Run{ID: "run-1", Status: tfe.RunPending, Plan: &tfe.Plan{ID: "plan-1"}}, nil
+}
+
+func (f *fakeRuns) Read(ctx context.Context, runID string) (*tfe.Run, error) {
+	f.readTimes = append(f.readTimes, time.Now())
+	r := f.reads[0]
+	if len(f.reads) > 1 {
+		f.reads = f.reads[1:]
+	}
+	return r, nil
+}
+
+func (f *fakeRuns) ReadWithOptions(ctx context.Context, runID string, options *tfe.RunReadOptions) (*tfe.Run, error) {
+	return &tfe.Run{ID: runID, CreatedBy: f.createdBy}, nil
+}
+
+func (f *fakeRuns) Discard(ctx context.Context, runID string, options tfe.RunDiscardOptions) error {
+	f.discarded = append(f.discarded, runID)
+	return nil
+}
+
+func (f *fakeRuns) Apply(ctx context.Context, runID string, options tfe.RunApplyOptions) error {
+	f.applied = append(f.applied, runID)
+	return nil
+}
+
+func (f *fakeRuns) Cancel(ctx context.Context, runID string, options tfe.RunCancelOptions) error {
+	f.canceled = append(f.canceled, runID)
+	return nil
+}
+
+func testRun(status tfe.RunStatus) *tfe.Run {
+	return &tfe.Run{
+		ID:      "run-1",
+		Status:  status,
+		Plan:    &tfe.Plan{ID: "plan-1"},
+		Actions: &tfe.RunActions{IsDiscardable: status == tfe.RunPlanned},
+	}
+}
+
+type fakeComments struct {
+	tfe.Comments
+	bodies []string
+}
+
+func (f *fakeComments) Create(ctx context.Context, runID string, options tfe.CommentCreateOptions) (*tfe.Comment, error) {
+	f.bodies = append(f.bodies, options.Body)
+	return &tfe.Comment{ID: "wsc-1", Body: options.Body}, nil
+}
+
+type fakeRunEvents struct {
+	tfe.RunEvents
+	events []*tfe.RunEvent
+}
+
+func (f *fakeRunEvents) List(ctx context.Context, runID string, options *tfe.RunEventListOptions) (*tfe.RunEventList, error) {
+	return &tfe.RunEventList{Items: f.events}, nil
+}
+
+type fakeOrganizations struct {
+	tfe.Organizations
+	err error
+	// readErrs are returned by the first reads of the entitlements one by
+	// one, before err.
+	readErrs []error
+	reads    int
+	// queue is returned as run queue, if nil reading the queue is forbidden.
+	queue []*tfe.Run
+}
+
+func (f *fakeOrganizations) ReadRunQueue(ctx context.Context, organization string, options tfe.ReadRunQueueOptions) (*tfe.RunQueue, error) {
+	if f.queue == nil {
+		return nil, tfe.ErrResourceNotFound
+	}
+	return &tfe.RunQueue{Items: f.queue}, nil
+}
+
+func (f *fakeOrganizations) ReadEntitlements(ctx context.Context, organization string) (*tfe.Entitlements, error) {
+	f.reads++
+	if f.reads <= len(f.readErrs) {
+		return nil, f.readErrs[f.reads-1]
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &tfe.Entitlements{ID: organization}, nil
+}
+
+// fakeWorkspaces serves workspace, the first reads fail with the errors in
+// readErrs one by one.
+type fakeWorkspaces struct {
+	tfe.Workspaces
+	workspace *tfe.Workspace
+	readErrs  []error
+	reads     int
+}
+
+func (f *fakeWorkspaces) Read(ctx context.Context, organization, workspace string) (*tfe.Workspace, error) {
+	f.reads++
+	if f.reads <= len(f.readErrs) {
+		return nil, f.readErrs[f.reads-1]
+	}
+	return f.workspace, nil
+}
+
+func (f *fakeWorkspaces) ReadByID(ctx context.Context, workspaceID string) (*tfe.Workspace, error) {
+	return f.workspace, nil
+}
+
+// fakeStateVersions serves state as the current state, if state is empty the
+// workspace has no state. The first notReady reads return an unprocessed state.
+type fakeStateVersions struct {
+	tfe.StateVersions
+	state    string
+	notReady int
+	// notFound is the number of reads that return no state.
+	notFound  int
+	reads     int
+	downloads int
+}
+
+func (f *fakeStateVersions) ReadCurrent(ctx context.Context, workspaceID string) (*tfe.StateVersion, error) {
+	f.reads++
+	if f.state == "" || f.reads <= f.notFound {
+		return nil, tfe.ErrResourceNotFound
+	}
+	return &tfe.StateVersion{
+		ID:                 "sv-1",
+		DownloadURL:        "https://example.com/state",
+		ResourcesProcessed: f.reads > f.notReady,
+		Run:                &tfe.Run{ID: "run-1"},
+	}, nil
+}
+
+func (f *fakeStateVersions) Download(ctx context.Context, url string) ([]byte, error) {
+	f.downloads++
+	return []byte(f.state), nil
+}
+
+func newTestClient(tfeClient *tfe.Client) *Client {
+	if tfeClient.Plans == nil {
+		tfeClient.Plans = &fakePlans{}
+	}
+	if tfeClient.Organizations == nil {
+		tfeClient.Organizations = &fakeOrganizations{}
+	}
+	return &Client{
+		client: tfeClient,
+		workspace: &tfe.Workspace{
+			ID:           "ws-1",
+			Name:         "workspace",
+			AutoApply:    true,
+			Organization: &tfe.Organization{Name: "organization"},
+		},
+	}
+}
+
+const testState = `{
+  "outputs": {
+    "endpoint": {"value": "https://example.com", "type": "string"}
+  },
+  "resources": [
+    {"mode": "managed", "type": "null_resource", "name": "single", "instances": [{}]},
+    {"mode": "managed", "type": "null_resource", "name": "counted", "instances": [{"index_key": 0}, {"index_key": 1}]},
+    {"mode": "data", "type": "null_data_source", "name": "data", "instances": [{}]},
+    {"module": "module.app[\"blue\"]", "mode": "managed", "type": "null_resource", "name": "nested", "instances": [{"index_key": "a"}]}
+  ]
+}`
+
+func TestDedupe(t *testing.T) {
+	assert.Nil(t, dedupe("target", nil))
+	assert.Equal(t, []string{"a.b", "c.d"}, dedupe("target", []string{"a.b", "c.d"}))
+	assert.Equal(t, []string{"c.d", "a.b", "e.f"}, dedupe("target", []string{"c.d", "a.b", "c.d", "e.f", "a.b"}))
+}
+
+func TestRun_validateTargetsPresent(t *testing.T) {
+	runs := &fakeRuns{}
+	c := newTestClient(&tfe.Client{
+		Runs:          runs,
+		StateVersions: &fakeStateVersions{state: testState},
+	})
+
+	targets := []string{
+		"null_resource.single",
+		"null_resource.counted[1]",
+		"data.null_data_source.data",
+		"module.app",
+		`module.app["blue"].null_resource.nested["a"]`,
+	}
+	_, err := c.Run(context.Background(), RunOptions{
+		TargetAddrs:                 targets,
+		ValidateTargetsAgainstState: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, runs.created, 1)
+	assert.Equal(t, targets, runs.created[0].TargetAddrs)
+}
+
+func TestRun_validateTargetsAbsent(t *testing.T) {
+	runs := &fakeRuns{}
+	c := newTestClient(&tfe.Client{
+		Runs:          runs,
+		StateVersions: &fakeStateVersions{state: testState},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		TargetAddrs:                 []string{"null_resource.single", "null_resource.missing", "null_resource.counted[2]", "module.other"},
+		ValidateTargetsAgainstState: true,
+	})
+
+	assert.EqualError(t, err, "target addresses not present in current state: null_resource.missing, null_resource.counted[2], module.other")
+	assert.Empty(t, runs.created)
+}
+
+type fakePlans struct {
+	tfe.Plans
+	plan *tfe.Plan
+	json string
+	logs string
+}
+
+func (f *fakePlans) Logs(ctx context.Context, planID string) (io.Reader, error) {
+	return strings.NewReader(f.logs), nil
+}
+
+func (f *fakePlans) Read(ctx context.Context, planID string) (*tfe.Plan, error) {
+	if f.plan != nil {
+		return f.plan, nil
+	}
+	return &tfe.Plan{ID: planID}, nil
+}
+
+func (f *fakePlans) ReadJSONOutput(ctx context.Context, planID string) ([]byte, error) {
+	if f.json == "" {
+		return []byte(testPlanJSON), nil
+	}
+	return []byte(f.json), nil
+}
+
+const testPlanJSON = `{
+  "format_version": "1.2",
+  "terraform_version": "1.9.0",
+  "resource_changes": [
+    {"address": "null_resource.single", "type": "null_resource", "name": "single", "change": {"actions": ["create"]}}
+  ]
+}`
+
+func TestWritePlanJSON(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Plans: &fakePlans{json: testPlanJSON},
+	})
+	path := filepath.Join(t.TempDir(), "infracost", "plan.json")
+
+	err := c.WritePlanJSON(context.Background(), "plan-1", path)
+	assert.NoError(t, err)
+
+	bytes, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.JSONEq(t, testPlanJSON, string(bytes))
+}
+
+func TestWritePlanJSON_invalidFormat(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Plans: &fakePlans{json: `{"resources": []}`},
+	})
+	path := filepath.Join(t.TempDir(), "plan.json")
+
+	err := c.WritePlanJSON(context.Background(), "plan-1", path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing format_version")
+	assert.NoFileExists(t, path)
+}
+
+func TestWriteArtifacts(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Plans: &fakePlans{json: testModulePlanJSON},
+	})
+	dir := filepath.Join(t.TempDir(), "artifacts")
+	output := RunOutput{
+		RunID:          "run-1",
+		PlanID:         "plan-1",
+		RunURL:         "https://app.terraform.io/app/organization/workspaces/workspace/runs/run-1",
+		Status:         tfe.RunPlannedAndFinished,
+		ResourceCounts: &ResourceCounts{Add: 1},
+	}
+
+	err := c.WriteArtifacts(context.Background(), dir, output, `{"endpoint":{"value":"https://example.com"}}`)
+	assert.NoError(t, err)
+
+	bytes, err := os.ReadFile(filepath.Join(dir, "plan.json"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, testModulePlanJSON, string(bytes))
+
+	bytes, err = os.ReadFile(filepath.Join(dir, "plan.md"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(bytes), "### Planned 1 add / 0 change / 0 destroy in workspace")
+	assert.Contains(t, string(bytes), "| Action | Resource |")
+
+	bytes, err = os.ReadFile(filepath.Join(dir, "outputs.json"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"endpoint":{"value":"https://example.com"}}`, string(bytes))
+}
+
+func TestPlanMarkdown(t *testing.T) {
+	plan := &planJSON{ResourceChanges: []resourceChange{
+		{Address: "null_resource.a"},
+		{Address: "null_resource.b"},
+	}}
+	plan.ResourceChanges[0].Change.Actions = []string{"delete", "create"}
+	plan.ResourceChanges[1].Change.Actions = []string{"no-op"}
+
+	assert.Equal(t, "### Summary\n\n| Action | Resource |\n|---|---|\n| delete, create | `null_resource.a` |\n", planMarkdown(plan, "Summary"))
+	assert.Equal(t, "### Summary\n\nNo changes.\n", planMarkdown(&planJSON{}, "Summary"))
+}
+
+const testModulePlanJSON = `{
+  "format_version": "1.2",
+  "resource_changes": [
+    {"address": "module.app.null_resource.a", "module_address": "module.app", "change": {"actions": ["update"]}},
+    {"address": "module.db.null_resource.b", "module_address": "module.db", "change": {"actions": ["no-op"]}},
+    {"address": "null_resource.root", "change": {"actions": ["delete", "create"]}}
+  ]
+}`
+
+func TestRun_allowedModulePrefixesInScope(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{json: testModulePlanJSON},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:                  RunTypeApply,
+		WaitForCompletion:     true,
+		AllowedModulePrefixes: []string{"module.app.", "null_resource.root"},
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, runs.discarded)
+}
+
+func TestRun_allowedModulePrefixesOutOfScope(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{json: testModulePlanJSON},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:                  RunTypeApply,
+		WaitForCompletion:     true,
+		AllowedModulePrefixes: []string{"module.app.", "module.db."},
+	})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "plan changes resources outside of the allowed modules: null_resource.root")
+	assert.Equal(t, []string{"run-1"}, runs.discarded)
+}
+
+func TestIsWithinAny(t *testing.T) {
+	prefixes := []string{"module.app", "module.db."}
+
+	assert.True(t, isWithinAny("module.app.null_resource.a", prefixes))
+	assert.True(t, isWithinAny(`module.app["a"].null_resource.a`, prefixes))
+	assert.True(t, isWithinAny("module.db.null_resource.b", prefixes))
+	assert.False(t, isWithinAny("module.application.null_resource.a", prefixes))
+	assert.False(t, isWithinAny("module.app_legacy.null_resource.a", prefixes))
+	assert.False(t, isWithinAny("module.dbx.null_resource.b", prefixes))
+}
+
+const testReplacePlanJSON = `{
+  "format_version": "1.2",
+  "resource_changes": [
+    {"address": "aws_db_instance.main", "change": {"actions": ["delete", "create"]}},
+    {"address": "module.cache.aws_elasticache_cluster.this[0]", "module_address": "module.cache", "change": {"actions": ["delete"]}},
+    {"address": "aws_instance.web", "change": {"actions": ["create", "delete"]}},
+    {"address": "aws_s3_bucket.logs", "change": {"actions": ["update"]}}
+  ]
+}`
+
+func TestRun_blockReplacementsOf(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{json: testReplacePlanJSON},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:                RunTypeApply,
+		WaitForCompletion:   true,
+		BlockReplacementsOf: []string{"aws_db_instance.main", "module.cache", "aws_s3_bucket.logs"},
+	})
+
+	assert.EqualError(t, err, "waiting for completion of run failed: plan replaces or destroys protected resources: aws_db_instance.main (delete, create), module.cache.aws_elasticache_cluster.this[0] (delete)")
+	assert.Equal(t, []string{"run-1"}, runs.discarded)
+}
+
+func TestRun_blockReplacementsOfNotAffected(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{json: testReplacePlanJSON},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:                RunTypeApply,
+		WaitForCompletion:   true,
+		BlockReplacementsOf: []string{"aws_s3_bucket.logs"},
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, runs.discarded)
+}
+
+func TestRun_maxPlanBytes(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{json: testReplacePlanJSON},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		MaxPlanBytes:      100,
+	})
+
+	assert.EqualError(t, err, fmt.Sprintf("waiting for completion of run failed: JSON plan is %v bytes, more than the limit of 100 bytes, reduce the size of the plan with targets or split the workspace", len(testReplacePlanJSON)))
+	assert.Equal(t, []string{"run-1"}, runs.discarded)
+}
+
+func TestRun_maxPlanBytesWithinLimit(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{json: testReplacePlanJSON},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		MaxPlanBytes:      len(testReplacePlanJSON),
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, runs.discarded)
+}
+
+func TestGetTerraformOutputs(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		StateVersions: &fakeStateVersions{state: testState},
+	})
+
+	outputs, err := c.GetTerraformOutputs(context.Background(), OutputOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"endpoint": `"https://example.com"`}, outputs)
+}
+
+// captureStdout returns everything fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+	w.Close()
+
+	out, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(out)
+}
+
+func TestGetTerraformOutputs_sortedLog(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		StateVersions: &fakeStateVersions{state: `{"outputs": {
+			"zone": {"value": "eu-1", "type": "string"},
+			"endpoint": {"value": "https://example.com", "type": "string"},
+			"name": {"value": "app", "type": "string"},
+			"api_key": {"value": "secret", "type": "string", "sensitive": true}
+		}}`},
+	})
+
+	out := captureStdout(t, func() {
+		_, err := c.GetTerraformOutputs(context.Background(), OutputOptions{Print: true})
+		assert.NoError(t, err)
+	})
+
+	assert.Equal(t, `Outputs from current state:
+ - api_key: ***
+ - endpoint: "https://example.com"
+ - name: "app"
+ - zone: "eu-1"
+`, out)
+}
+
+func TestGetTerraformOutputs_requiredPresent(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		StateVersions: &fakeStateVersions{state: testState},
+	})
+
+	outputs, err := c.GetTerraformOutputs(context.Background(), OutputOptions{Required: []string{"endpoint"}})
+
+	assert.NoError(t, err)
+	assert.Contains(t, outputs, "endpoint")
+}
+
+func TestGetTerraformOutputs_requiredMissing(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		StateVersions: &fakeStateVersions{state: testState},
+	})
+
+	_, err := c.GetTerraformOutputs(context.Background(), OutputOptions{Required: []string{"endpoint", "bucket", "queue-url"}})
+
+	assert.EqualError(t, err, "required outputs are missing: bucket, queue-url")
+}
+
+func TestGetTerraformOutputs_missingState(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		StateVersions: &fakeStateVersions{},
+	})
+
+	for _, behavior := range []MissingStateBehavior{MissingStateIgnore, MissingStateWarn} {
+		outputs, err := c.GetTerraformOutputs(context.Background(), OutputOptions{OnMissingState: behavior})
+
+		assert.NoError(t, err)
+		assert.Empty(t, outputs)
+	}
+
+	_, err := c.GetTerraformOutputs(context.Background(), OutputOptions{OnMissingState: MissingStateFail})
+
+	assert.ErrorIs(t, err, ErrNoState)
+}
+
+func TestRun_changedResources(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplying), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{json: testModulePlanJSON},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"module.app.null_resource.a", "null_resource.root"}, output.ChangedResources)
+}
+
+type fakeTaskStages struct {
+	tfe.TaskStages
+	stages []*tfe.TaskStage
+	// running is the number of List calls that report every stage as running.
+	running int
+}
+
+func (f *fakeTaskStages) List(ctx context.Context, runID string, options *tfe.TaskStageListOptions) (*tfe.TaskStageList, error) {
+	var items []*tfe.TaskStage
+	for _, ts := range f.stages {
+		status := ts.Status
+		if f.running > 0 {
+			status = tfe.TaskStageRunning
+		}
+		items = append(items, &tfe.TaskStage{ID: ts.ID, Stage: ts.Stage, Status: status})
+	}
+	if f.running > 0 {
+		f.running--
+	}
+	return &tfe.TaskStageList{Items: items}, nil
+}
+
+func (f *fakeTaskStages) Read(ctx context.Context, taskStageID string, options *tfe.TaskStageReadOptions) (*tfe.TaskStage, error) {
+	for _, ts := range f.stages {
+		if ts.ID == taskStageID {
+			return ts, nil
+		}
+	}
+	return nil, tfe.ErrResourceNotFound
+}
+
+func testTaskStage(id string, stage tfe.Stage, results ...*tfe.TaskResult) *tfe.TaskStage {
+	return &tfe.TaskStage{ID: id, Stage: stage, TaskResults: results}
+}
+
+func TestRun_prePlanTasksPassed(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPrePlanRunning), testRun(tfe.RunPlannedAndFinished)}}
+	c := newTestClient(&tfe.Client{
+		Runs: runs,
+		TaskStages: &fakeTaskStages{stages: []*tfe.TaskStage{
+			testTaskStage("ts-1", tfe.PrePlan,
+				&tfe.TaskResult{TaskName: "scan", Status: tfe.TaskPassed, WorkspaceTaskEnforcementLevel: tfe.Mandatory},
+				&tfe.TaskResult{TaskName: "lint", Status: tfe.TaskFailed, WorkspaceTaskEnforcementLevel: tfe.Advisory},
+			),
+			testTaskStage("ts-2", tfe.PostPlan,
+				&tfe.TaskResult{TaskName: "cost", Status: tfe.TaskFailed, WorkspaceTaskEnforcementLevel: tfe.Mandatory},
+			),
+		}},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:               RunTypePlan,
+		WaitForCompletion:  true,
+		ReportPrePlanTasks: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, output.PrePlanTaskResults, 2)
+}
+
+func TestRun_prePlanTasksFailed(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPrePlanRunning), testRun(tfe.RunErrored)}}
+	c := newTestClient(&tfe.Client{
+		Runs: runs,
+		TaskStages: &fakeTaskStages{stages: []*tfe.TaskStage{
+			testTaskStage("ts-1", tfe.PrePlan,
+				&tfe.TaskResult{TaskName: "scan", Status: tfe.TaskFailed, WorkspaceTaskEnforcementLevel: tfe.Mandatory, Message: "2 issues found"},
+			),
+		}},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:               RunTypePlan,
+		WaitForCompletion:  true,
+		ReportPrePlanTasks: true,
+	})
+
+	assert.EqualError(t, err, "mandatory pre plan run tasks did not pass: scan (2 issues found)")
+	assert.Len(t, output.PrePlanTaskResults, 1)
+}
+
+func TestRun_postApplyTasksPassed(t *testing.T) {
+	taskStages := &fakeTaskStages{
+		stages: []*tfe.TaskStage{
+			testTaskStage("ts-1", tfe.PostApply,
+				&tfe.TaskResult{TaskName: "smoke-test", Status: tfe.TaskPassed, WorkspaceTaskEnforcementLevel: tfe.Mandatory},
+			),
+		},
+		running: 2,
+	}
+	c := newTestClient(&tfe.Client{
+		Runs:       &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplied)}},
+		TaskStages: taskStages,
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:                  RunTypeApply,
+		WaitForCompletion:     true,
+		WaitForPostApplyTasks: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, taskStages.running)
+	assert.Len(t, output.PostApplyTaskResults, 1)
+}
+
+func TestRun_postApplyTasksFailed(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Runs: &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplied)}},
+		TaskStages: &fakeTaskStages{stages: []*tfe.TaskStage{
+			testTaskStage("ts-1", tfe.PostApply,
+				&tfe.TaskResult{TaskName: "smoke-test", Status: tfe.TaskFailed, WorkspaceTaskEnforcementLevel: tfe.Mandatory, Message: "health check returned 503"},
+			),
+		}},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:                  RunTypeApply,
+		WaitForCompletion:     true,
+		WaitForPostApplyTasks: true,
+	})
+
+	assert.EqualError(t, err, "mandatory post apply run tasks did not pass: smoke-test (health check returned 503)")
+	assert.Len(t, output.PostApplyTaskResults, 1)
+}
+
+func TestRun_timeout(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		Timeout:           10 * time.Millisecond,
+	})
+
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Contains(t, err.Error(), "last status of run was planning")
+	assert.Contains(t, err.Error(), "https://app.terraform.io/app/organization/workspaces/workspace/runs/run-1")
+}
+
+func TestRun_fireAndForget(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		FireAndForget:     true,
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, runs.readTimes)
+	assert.Equal(t, "run-1", output.RunID)
+	assert.Equal(t, "https://app.terraform.io/app/organization/workspaces/workspace/runs/run-1", output.RunURL)
+	assert.Nil(t, output.HasChanges)
+	assert.Empty(t, output.Status)
+}
+
+func TestRun_planAndApplyURL(t *testing.T) {
+	r := testRun(tfe.RunApplied)
+	r.Apply = &tfe.Apply{ID: "apply-1"}
+	c := newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{r}}})
+
+	output, err := c.Run(context.Background(), RunOptions{ResumeRunID: "run-1"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://app.terraform.io/app/organization/workspaces/workspace/runs/run-1/plans/plan-1", output.PlanURL)
+	assert.Equal(t, "https://app.terraform.io/app/organization/workspaces/workspace/runs/run-1/applies/apply-1", output.ApplyURL)
+}
+
+func TestFixedPollStrategy(t *testing.T) {
+	s := FixedPollStrategy{Interval: time.Second, Timeout: time.Minute}
+
+	sleep, giveUp := s.Next(0, tfe.RunPending)
+	assert.Equal(t, time.Second, sleep)
+	assert.False(t, giveUp)
+
+	sleep, giveUp = s.Next(30*time.Second, tfe.RunPlanning)
+	assert.Equal(t, time.Second, sleep)
+	assert.False(t, giveUp)
+
+	_, giveUp = s.Next(time.Minute+time.Millisecond, tfe.RunPlanning)
+	assert.True(t, giveUp)
+}
+
+func TestBackoffPollStrategy(t *testing.T) {
+	s := BackoffPollStrategy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, Timeout: time.Minute}
+
+	for _, tc := range []struct {
+		elapsed time.Duration
+		sleep   time.Duration
+	}{
+		{0, time.Second},
+		{500 * time.Millisecond, time.Second},
+		{4 * time.Second, 4 * time.Second},
+		{20 * time.Second, 10 * time.Second},
+		{55 * time.Second, 5 * time.Second},
+	} {
+		sleep, giveUp := s.Next(tc.elapsed, tfe.RunPlanning)
+		assert.Equal(t, tc.sleep, sleep, tc.elapsed)
+		assert.False(t, giveUp, tc.elapsed)
+	}
+
+	_, giveUp := s.Next(time.Minute+time.Millisecond, tfe.RunPlanning)
+	assert.True(t, giveUp)
+}
+
+type countingPollStrategy struct {
+	statuses []tfe.RunStatus
+}
+
+func (s *countingPollStrategy) Next(elapsed time.Duration, status tfe.RunStatus) (time.Duration, bool) {
+	s.statuses = append(s.statuses, status)
+	return time.Millisecond, len(s.statuses) > 2
+}
+
+func TestRun_pollStrategy(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanQueued), testRun(tfe.RunPlanning)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+	strategy := &countingPollStrategy{}
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		PollStrategy:      strategy,
+	})
+
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Equal(t, []tfe.RunStatus{tfe.RunPending, tfe.RunPlanQueued, tfe.RunPlanning}, strategy.statuses)
+	assert.Len(t, runs.readTimes, 2)
+}
+
+func TestRun_queueDepth(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Runs: &fakeRuns{},
+		Organizations: &fakeOrganizations{queue: []*tfe.Run{
+			{ID: "run-a"}, {ID: "run-b"}, {ID: "run-1"}, {ID: "run-c"},
+		}},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.Int(2), output.QueueDepth)
+}
+
+func TestRun_queueDepthNotQueued(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Runs:          &fakeRuns{},
+		Organizations: &fakeOrganizations{queue: []*tfe.Run{{ID: "run-a"}, {ID: "run-b"}}},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{})
+
+	assert.NoError(t, err)
+	assert.Nil(t, output.QueueDepth)
+}
+
+func TestRun_queueDepthUnavailable(t *testing.T) {
+	c := newTestClient(&tfe.Client{Runs: &fakeRuns{}})
+
+	output, err := c.Run(context.Background(), RunOptions{})
+
+	assert.NoError(t, err)
+	assert.Nil(t, output.QueueDepth)
+}
+
+func TestRun_resume(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlannedAndFinished)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	created, err := c.Run(context.Background(), RunOptions{Type: RunTypePlan})
+	assert.NoError(t, err)
+	assert.Equal(t, "run-1", created.RunID)
+
+	resumed, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		ResumeRunID:       created.RunID,
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, runs.created, 1)
+	assert.Equal(t, created.RunURL, resumed.RunURL)
+	assert.Equal(t, tfe.Bool(false), resumed.HasChanges)
+}
+
+func TestRun_stateFileReattach(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tfe-run.json")
+
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	// The first attempt loses the connection while waiting for the run
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Run(ctx, RunOptions{Type: RunTypePlan, WaitForCompletion: true, StateFile: path})
+	assert.Error(t, err)
+	assert.Len(t, runs.created, 1)
+	assert.FileExists(t, path)
+
+	// The restarted step reattaches to the run instead of creating a new one
+	runs.reads = []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanning), testRun(tfe.RunPlannedAndFinished)}
+	output, err := c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true, StateFile: path})
+
+	assert.NoError(t, err)
+	assert.Len(t, runs.created, 1)
+	assert.Equal(t, "run-1", output.RunID)
+	assert.Equal(t, tfe.RunPlannedAndFinished, output.Status)
+	assert.NoFileExists(t, path, "state file must be removed once the run finished")
+
+	// A later step in the same job creates a new run
+	output, err = c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true, StateFile: path})
+
+	assert.NoError(t, err)
+	assert.Len(t, runs.created, 2)
+	assert.False(t, output.ReusedExistingRun)
+}
+
+func TestRun_stateFileFinishedRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tfe-run.json")
+	err := os.WriteFile(path, []byte(`{"workspace_id": "ws-1", "run_id": "run-0"}`), 0644)
+	assert.NoError(t, err)
+
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	output, err := c.Run(context.Background(), RunOptions{StateFile: path})
+
+	assert.NoError(t, err)
+	assert.Len(t, runs.created, 1, "finished run must not be resumed")
+	assert.False(t, output.ReusedExistingRun)
+}
+
+func TestRun_stateFileOtherWorkflowRun(t *testing.T) {
+	t.Setenv("GITHUB_RUN_ID", "1658821493")
+	t.Setenv("GITHUB_RUN_ATTEMPT", "2")
+	path := filepath.Join(t.TempDir(), "tfe-run.json")
+	err := os.WriteFile(path, []byte(`{"workspace_id": "ws-1", "run_id": "run-0", "workflow_run_id": "1658821493", "workflow_run_attempt": "1"}`), 0644)
+	assert.NoError(t, err)
+
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err = c.Run(context.Background(), RunOptions{StateFile: path})
+
+	assert.NoError(t, err)
+	assert.Len(t, runs.created, 1, "run of another attempt must not be resumed")
+
+	bytes, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"workspace_id": "ws-1", "run_id": "run-1", "workflow_run_id": "1658821493", "workflow_run_attempt": "2"}`, string(bytes))
+}
+
+func TestRun_stateFileOtherWorkspace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tfe-run.json")
+	err := os.WriteFile(path, []byte(`{"workspace_id": "ws-2", "run_id": "run-0"}`), 0644)
+	assert.NoError(t, err)
+
+	runs := &fakeRuns{}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	output, err := c.Run(context.Background(), RunOptions{StateFile: path})
+
+	assert.NoError(t, err)
+	assert.Len(t, runs.created, 1)
+	assert.Equal(t, "run-1", output.RunID)
+
+	bytes, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"workspace_id": "ws-1", "run_id": "run-1"}`, string(bytes))
+}
+
+func TestRestrictToBranches(t *testing.T) {
+	branches := []string{"main", "release"}
+
+	assert.Equal(t, RunTypeApply, restrictToBranches(RunTypeApply, branches, "refs/heads/main"))
+	assert.Equal(t, RunTypeApply, restrictToBranches(RunTypeApply, branches, "refs/heads/release"))
+	assert.Equal(t, RunTypePlan, restrictToBranches(RunTypeApply, branches, "refs/heads/feature/x"))
+	assert.Equal(t, RunTypePlan, restrictToBranches(RunTypeApply, branches, "refs/pull/1/merge"))
+	assert.Equal(t, RunTypeApply, restrictToBranches(RunTypeApply, nil, "refs/heads/feature/x"))
+	assert.Equal(t, RunTypeDestroy, restrictToBranches(RunTypeDestroy, branches, "refs/heads/feature/x"))
+}
+
+func TestCheckApplyStage(t *testing.T) {
+	branches := []string{"main"}
+
+	assert.NoError(t, checkApplyStage(StageApply, branches, "refs/heads/main"))
+	assert.NoError(t, checkApplyStage(StageApply, nil, "refs/heads/feature/x"))
+	assert.NoError(t, checkApplyStage(StagePlan, branches, "refs/heads/feature/x"))
+	assert.ErrorIs(t, checkApplyStage(StageApply, branches, "refs/heads/feature/x"), ErrBranchNotAllowed)
+}
+
+func TestRun_planOnly(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlannedAndFinished)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+	runType := restrictToBranches(RunTypeApply, []string{"main"}, "refs/heads/feature/x")
+
+	_, err := c.Run(context.Background(), RunOptions{Type: runType})
+
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.Bool(true), runs.created[0].PlanOnly, "downgraded runs must not be applied")
+
+	runs.created = nil
+
+	_, err = c.Run(context.Background(), RunOptions{Type: RunTypeApply})
+
+	assert.NoError(t, err)
+	assert.Nil(t, runs.created[0].PlanOnly)
+}
+
+func TestParseAddrs(t *testing.T) {
+	addrs, err := parseAddrs("a.b\nc.d", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.b", "c.d"}, addrs)
+
+	addrs, err = parseAddrs("", `["a.b", "module.c[\"d\"].e.f"]`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.b", `module.c["d"].e.f`}, addrs)
+
+	addrs, err = parseAddrs("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, addrs)
+
+	addrs, err = parseAddrs("", "[]")
+	assert.NoError(t, err)
+	assert.Nil(t, addrs)
+}
+
+func TestParseAddrs_jsonTakesPrecedence(t *testing.T) {
+	addrs, err := parseAddrs("a.b\nc.d", `["e.f"]`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e.f"}, addrs)
+}
+
+func TestParseAddrs_invalidJSON(t *testing.T) {
+	_, err := parseAddrs("", `"a.b"`)
+	assert.Error(t, err)
+
+	_, err = parseAddrs("", `[1, 2]`)
+	assert.Error(t, err)
+}
+
+func TestRun_sigterm(t *testing.T) {
+	ctx, stop := signalContext()
+	defer stop()
+
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+
+	_, err := c.Run(ctx, RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		CancelOnInterrupt: true,
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []string{"run-1"}, runs.canceled)
+}
+
+func TestRun_summary(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplying), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs: runs,
+		Plans: &fakePlans{
+			plan: &tfe.Plan{ID: "plan-1", ResourceAdditions: 3, ResourceChanges: 1},
+			json: testModulePlanJSON,
+		},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Applied 3 add / 1 change / 0 destroy in workspace — https://app.terraform.io/app/organization/workspaces/workspace/runs/run-1", c.Summary(output))
+}
+
+type fakePolicyChecks struct {
+	tfe.PolicyChecks
+	checks     []*tfe.PolicyCheck
+	lists      int
+	overridden []string
+}
+
+func (f *fakePolicyChecks) Override(ctx context.Context, policyCheckID string) (*tfe.PolicyCheck, error) {
+	f.overridden = append(f.overridden, policyCheckID)
+	return &tfe.PolicyCheck{ID: policyCheckID, Status: tfe.PolicyOverridden}, nil
+}
+
+func (f *fakePolicyChecks) List(ctx context.Context, runID string, options *tfe.PolicyCheckListOptions) (*tfe.PolicyCheckList, error) {
+	f.lists++
+	return &tfe.PolicyCheckList{Items: f.checks}, nil
+}
+
+func testOverridablePolicyCheck(canOverride bool) *tfe.PolicyCheck {
+	return &tfe.PolicyCheck{
+		ID:          "polchk-1",
+		Status:      tfe.PolicySoftFailed,
+		Actions:     &tfe.PolicyActions{IsOverridable: true},
+		Permissions: &tfe.PolicyPermissions{CanOverride: canOverride},
+		Result:      &tfe.PolicyResult{Passed: 2, SoftFailed: 1, TotalFailed: 1},
+	}
+}
+
+func TestRun_policyOverride(t *testing.T) {
+	policyChecks := &fakePolicyChecks{checks: []*tfe.PolicyCheck{testOverridablePolicyCheck(true)}}
+	c := newTestClient(&tfe.Client{
+		Runs:         &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPolicyOverride), testRun(tfe.RunPolicyOverride), testRun(tfe.RunApplying), testRun(tfe.RunApplied)}},
+		PolicyChecks: policyChecks,
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		OnPolicyOverride:  PolicyOverrideOverride,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"polchk-1"}, policyChecks.overridden)
+	assert.Equal(t, tfe.RunApplied, output.Status)
+}
+
+func TestRun_policyOverrideNotPermitted(t *testing.T) {
+	policyChecks := &fakePolicyChecks{checks: []*tfe.PolicyCheck{testOverridablePolicyCheck(false)}}
+	c := newTestClient(&tfe.Client{
+		Runs:         &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPolicyOverride)}},
+		PolicyChecks: policyChecks,
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		OnPolicyOverride:  PolicyOverrideOverride,
+	})
+
+	assert.ErrorIs(t, err, ErrPolicyOverrideRequired)
+	assert.Contains(t, err.Error(), "the token may not override policy check polchk-1")
+	assert.Empty(t, policyChecks.overridden)
+}
+
+func TestRun_policyOverrideFail(t *testing.T) {
+	policyChecks := &fakePolicyChecks{checks: []*tfe.PolicyCheck{testOverridablePolicyCheck(true)}}
+	c := newTestClient(&tfe.Client{
+		Runs:         &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPolicyOverride)}},
+		PolicyChecks: policyChecks,
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		OnPolicyOverride:  PolicyOverrideFail,
+	})
+
+	assert.ErrorIs(t, err, ErrPolicyOverrideRequired)
+	assert.EqualError(t, err, "waiting for completion of run failed: failed policies must be overridden, run run-1")
+	assert.Empty(t, policyChecks.overridden)
+	assert.Equal(t, 1, policyChecks.lists)
+}
+
+func TestRun_softFailPolicyIsSuccess(t *testing.T) {
+	policyChecks := &fakePolicyChecks{checks: []*tfe.PolicyCheck{
+		{ID: "polchk-1", Status: tfe.PolicySoftFailed, Result: &tfe.PolicyResult{Passed: 2, SoftFailed: 1, TotalFailed: 1}},
+	}}
+	c := newTestClient(&tfe.Client{
+		Runs:         &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPolicySoftFailed)}},
+		PolicyChecks: policyChecks,
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:                    RunTypePlan,
+		WaitForCompletion:       true,
+		SoftFailPolicyIsSuccess: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.RunPolicySoftFailed, output.Status)
+	assert.Equal(t, 1, policyChecks.lists)
+}
+
+func TestRun_softFailPolicy(t *testing.T) {
+	policyChecks := &fakePolicyChecks{checks: []*tfe.PolicyCheck{
+		{ID: "polchk-1", Status: tfe.PolicySoftFailed, Result: &tfe.PolicyResult{SoftFailed: 1, TotalFailed: 1}},
+	}}
+	c := newTestClient(&tfe.Client{
+		Runs:         &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPolicySoftFailed)}},
+		PolicyChecks: policyChecks,
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+	})
+
+	assert.EqualError(t, err, "run run-1 finished with status policy soft failed")
+	assert.Equal(t, 1, policyChecks.lists)
+}
+
+func TestRun_policyOverrideRequired(t *testing.T) {
+	policyChecks := &fakePolicyChecks{checks: []*tfe.PolicyCheck{
+		{ID: "polchk-1", Status: tfe.PolicySoftFailed, Result: &tfe.PolicyResult{SoftFailed: 1, TotalFailed: 1}},
+	}}
+	c := newTestClient(&tfe.Client{
+		Runs:         &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPolicySoftFailed)}},
+		PolicyChecks: policyChecks,
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:                    RunTypePlan,
+		WaitForCompletion:       true,
+		SoftFailPolicyIsSuccess: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.Bool(true), output.PolicyOverrideRequired)
+
+	t.Run("overridden", func(t *testing.T) {
+		applied := testRun(tfe.RunApplied)
+		applied.PolicyChecks = []*tfe.PolicyCheck{{ID: "polchk-1"}}
+		c := newTestClient(&tfe.Client{
+			Runs: &fakeRuns{reads: []*tfe.Run{applied}},
+			PolicyChecks: &fakePolicyChecks{checks: []*tfe.PolicyCheck{
+				{ID: "polchk-1", Status: tfe.PolicyOverridden},
+			}},
+			StateVersions: &fakeStateVersions{},
+		})
+
+		output, err := c.Run(context.Background(), RunOptions{Type: RunTypeApply, WaitForCompletion: true})
+
+		assert.NoError(t, err)
+		assert.Equal(t, tfe.Bool(true), output.PolicyOverrideRequired)
+	})
+
+	t.Run("passed", func(t *testing.T) {
+		c := newTestClient(&tfe.Client{
+			Runs: &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlannedAndFinished)}},
+		})
+
+		output, err := c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true})
+
+		assert.NoError(t, err)
+		assert.Equal(t, tfe.Bool(false), output.PolicyOverrideRequired)
+	})
+}
+
+type fakeCostEstimates struct {
+	tfe.CostEstimates
+	costEstimate *tfe.CostEstimate
+}
+
+func (f *fakeCostEstimates) Read(ctx context.Context, costEstimateID string) (*tfe.CostEstimate, error) {
+	return f.costEstimate, nil
+}
+
+type fakeApplies struct {
+	tfe.Applies
+	apply *tfe.Apply
+}
+
+func (f *fakeApplies) Read(ctx context.Context, applyID string) (*tfe.Apply, error) {
+	return f.apply, nil
+}
+
+func TestRun_planErrored(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Runs:  &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunErrored)}},
+		Plans: &fakePlans{plan: &tfe.Plan{ID: "plan-1", Status: tfe.PlanErrored}},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true})
+
+	assert.ErrorIs(t, err, ErrPlanErrored)
+	assert.NotErrorIs(t, err, ErrPartialApply)
+	assert.EqualError(t, err, "plan errored, run run-1 could not be planned")
+}
+
+func TestRun_speculativePlanErroredLogs(t *testing.T) {
+	var logs strings.Builder
+	for i := 1; i <= 25; i++ {
+		fmt.Fprintf(&logs, "line %v\n", i)
+	}
+	logs.WriteString(`{"@level":"error","@message":"Error: Unsupported argument","type":"diagnostic"}` + "\n")
+	c := newTestClient(&tfe.Client{
+		Runs:  &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunErrored)}},
+		Plans: &fakePlans{plan: &tfe.Plan{ID: "plan-1", Status: tfe.PlanErrored}, logs: logs.String()},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true})
+
+	assert.ErrorIs(t, err, ErrPlanErrored)
+	assert.True(t, strings.HasPrefix(err.Error(), "plan errored, run run-1 could not be planned, last lines of the plan log:\nline 7\n"))
+	assert.True(t, strings.HasSuffix(err.Error(), "\nline 25\nError: Unsupported argument"))
+	assert.NotContains(t, err.Error(), "line 6\n")
+}
+
+func TestRun_costEstimationErrored(t *testing.T) {
+	errored := testRun(tfe.RunErrored)
+	errored.CostEstimate = &tfe.CostEstimate{ID: "ce-1"}
+	c := newTestClient(&tfe.Client{
+		Runs:  &fakeRuns{reads: []*tfe.Run{errored}},
+		Plans: &fakePlans{plan: &tfe.Plan{ID: "plan-1", Status: tfe.PlanFinished}},
+		CostEstimates: &fakeCostEstimates{costEstimate: &tfe.CostEstimate{
+			ID:           "ce-1",
+			Status:       tfe.CostEstimateErrored,
+			ErrorMessage: "failed to fetch prices",
+		}},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true})
+
+	assert.ErrorIs(t, err, ErrCostEstimationErrored)
+	assert.EqualError(t, err, "cost estimation errored, run run-1: failed to fetch prices")
+}
+
+func TestRun_applyErrored(t *testing.T) {
+	errored := testRun(tfe.RunErrored)
+	errored.Apply = &tfe.Apply{ID: "apply-1"}
+	c := newTestClient(&tfe.Client{
+		Runs:    &fakeRuns{reads: []*tfe.Run{errored}},
+		Applies: &fakeApplies{apply: &tfe.Apply{ID: "apply-1", Status: tfe.ApplyErrored}},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{Type: RunTypeApply, WaitForCompletion: true})
+
+	assert.ErrorIs(t, err, ErrApplyErrored)
+	assert.NotErrorIs(t, err, ErrPartialApply)
+}
+
+func TestRun_partialApply(t *testing.T) {
+	errored := testRun(tfe.RunErrored)
+	errored.Apply = &tfe.Apply{ID: "apply-1"}
+	c := newTestClient(&tfe.Client{
+		Runs:  &fakeRuns{reads: []*tfe.Run{errored}},
+		Plans: &fakePlans{plan: &tfe.Plan{ID: "plan-1", Status: tfe.PlanFinished}},
+		Applies: &fakeApplies{apply: &tfe.Apply{
+			ID:                   "apply-1",
+			Status:               tfe.ApplyErrored,
+			ResourceAdditions:    2,
+			ResourceDestructions: 1,
+		}},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{Type: RunTypeApply, WaitForCompletion: true})
+
+	assert.ErrorIs(t, err, ErrPartialApply)
+	assert.ErrorIs(t, err, ErrApplyErrored)
+	assert.EqualError(t, err, "apply errored, infrastructure has been partially changed, run run-1 applied 3 resource changes before failing (2 added, 0 changed, 1 destroyed)")
+}
+
+// fakeVariables stores variables in memory, like the API creating a variable
+// with a key that already exists fails.
+type fakeVariables struct {
+	tfe.Variables
+	variables []*tfe.Variable
+	// beforeList is called before variables are listed.
+	beforeList func(f *fakeVariables)
+	lists      int
+	// createErr is returned by Create, afterCreate is called after a
+	// variable was created.
+	createErr   error
+	afterCreate func()
+}
+
+func (f *fakeVariables) List(ctx context.Context, workspaceID string, options *tfe.VariableListOptions) (*tfe.VariableList, error) {
+	f.lists++
+	if f.beforeList != nil {
+		f.beforeList(f)
+	}
+	return &tfe.VariableList{Items: f.variables}, nil
+}
+
+func (f *fakeVariables) Create(ctx context.Context, workspaceID string, options tfe.VariableCreateOptions) (*tfe.Variable, error) {
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	if f.afterCreate != nil {
+		defer f.afterCreate()
+	}
+	for _, v := range f.variables {
+		if v.Key == *options.Key && v.Category == *options.Category {
+			return nil, errors.New("key has already been taken")
+		}
+	}
+	v := &tfe.Variable{ID: fmt.Sprintf("var-%v", len(f.variables)+1), Key: *options.Key, Value: *options.Value, Category: *options.Category}
+	f.variables = append(f.variables, v)
+	return v, nil
+}
+
+func (f *fakeVariables) Delete(ctx context.Context, workspaceID string, variableID string) error {
+	for i, v := range f.variables {
+		if v.ID == variableID {
+			f.variables = append(f.variables[:i], f.variables[i+1:]...)
+			return nil
+		}
+	}
+	return tfe.ErrResourceNotFound
+}
+
+func TestAcquireLock(t *testing.T) {
+	variables := &fakeVariables{}
+	c := newTestClient(&tfe.Client{Variables: variables})
+
+	err := c.AcquireLock(context.Background(), "job-1", time.Second)
+
+	assert.NoError(t, err)
+	assert.Len(t, variables.variables, 1)
+	assert.Equal(t, "TFE_RUN_LOCK", variables.variables[0].Key)
+	assert.Equal(t, "job-1", variables.variables[0].Value)
+}
+
+func TestAcquireLock_contended(t *testing.T) {
+	variables := &fakeVariables{
+		variables: []*tfe.Variable{{ID: "var-1", Key: "TFE_RUN_LOCK", Value: "job-1", Category: tfe.CategoryEnv}},
+	}
+	c := newTestClient(&tfe.Client{Variables: variables})
+
+	err := c.AcquireLock(context.Background(), "job-2", 10*time.Millisecond)
+
+	assert.ErrorIs(t, err, ErrLockTimeout)
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Contains(t, err.Error(), "held by job-1")
+
+	// The other invocation releases the lock while waiting
+	variables.beforeList = func(f *fakeVariables) {
+		if f.lists == 3 {
+			f.variables = nil
+		}
+	}
+	variables.lists = 0
+
+	err = c.AcquireLock(context.Background(), "job-2", time.Second)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "job-2", variables.variables[0].Value)
+}
+
+func TestAcquireLock_createFails(t *testing.T) {
+	variables := &fakeVariables{createErr: tfe.ErrResourceNotFound}
+	c := newTestClient(&tfe.Client{Variables: variables})
+
+	err := c.AcquireLock(context.Background(), "job-1", time.Minute)
+
+	assert.ErrorIs(t, err, tfe.ErrResourceNotFound)
+	assert.NotErrorIs(t, err, ErrLockTimeout, "errors other than conflicts must not be retried")
+}
+
+func TestAcquireLock_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	variables := &fakeVariables{afterCreate: cancel}
+	c := newTestClient(&tfe.Client{Variables: variables})
+
+	err := c.AcquireLock(ctx, "job-1", time.Minute)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, variables.variables, "lock must be released when canceled after creating it")
+}
+
+func TestLock_sharedJobURL(t *testing.T) {
+	t.Setenv("GITHUB_SERVER_URL", "https://github.com")
+	t.Setenv("GITHUB_REPOSITORY", "octocat/infra")
+	t.Setenv("GITHUB_RUN_ID", "1658821493")
+	t.Setenv("GITHUB_RUN_ATTEMPT", "1")
+	t.Setenv("GITHUB_JOB", "deploy")
+	t.Setenv("GITHUB_EVENT_PATH", "")
+
+	variables := &fakeVariables{}
+	c1 := newTestClient(&tfe.Client{Variables: variables})
+	c2 := newTestClient(&tfe.Client{Variables: variables})
+	owner1, owner2 := newLockOwner(), newLockOwner()
+
+	assert.NotEqual(t, owner1, owner2, "jobs of a matrix must not share the lock owner")
+	assert.Contains(t, owner1, "https://github.com/octocat/infra/actions/runs/1658821493 (job deploy, attempt 1)")
+
+	err := c1.AcquireLock(context.Background(), owner1, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.CategoryEnv, variables.variables[0].Category, "lock must not be an input variable of the run")
+
+	err = c2.AcquireLock(context.Background(), owner2, 10*time.Millisecond)
+	assert.ErrorIs(t, err, ErrLockTimeout)
+
+	err = c2.ReleaseLock(context.Background(), owner2)
+	assert.NoError(t, err)
+	assert.Len(t, variables.variables, 1, "lock of the other job must not be released")
+
+	err = c1.ReleaseLock(context.Background(), owner1)
+	assert.NoError(t, err)
+	assert.Empty(t, variables.variables)
+}
+
+func TestReleaseLock(t *testing.T) {
+	variables := &fakeVariables{
+		variables: []*tfe.Variable{{ID: "var-1", Key: "TFE_RUN_LOCK", Value: "job-1", Category: tfe.CategoryEnv}},
+	}
+	c := newTestClient(&tfe.Client{Variables: variables})
+
+	err := c.ReleaseLock(context.Background(), "job-2")
+
+	assert.NoError(t, err)
+	assert.Len(t, variables.variables, 1, "lock of another owner must not be released")
+
+	err = c.ReleaseLock(context.Background(), "job-1")
+
+	assert.NoError(t, err)
+	assert.Empty(t, variables.variables)
+}
+
+func TestWriteResultFile(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	applied := testRun(tfe.RunApplied)
+	applied.CreatedAt = created
+	applied.StatusTimestamps = &tfe.RunStatusTimestamps{
+		PlannedAndFinishedAt: created.Add(time.Minute),
+		AppliedAt:            created.Add(90 * time.Second),
+	}
+	applied.CostEstimate = &tfe.CostEstimate{ID: "ce-1"}
+	c := newTestClient(&tfe.Client{
+		Runs: &fakeRuns{reads: []*tfe.Run{applied}},
+		PolicyChecks: &fakePolicyChecks{checks: []*tfe.PolicyCheck{
+			{ID: "polchk-1", Status: tfe.PolicyPasses, Result: &tfe.PolicyResult{Passed: 3}},
+		}},
+		CostEstimates: &fakeCostEstimates{costEstimate: &tfe.CostEstimate{
+			ID:                  "ce-1",
+			ProposedMonthlyCost: "12.50",
+			DeltaMonthlyCost:    "2.50",
+		}},
+		StateVersions: &fakeStateVersions{state: `{"outputs": {
+			"endpoint": {"value": "https://example.com", "type": "string"},
+			"password": {"value": "hunter2", "type": "string", "sensitive": true}
+		}}`},
+	})
+	path := filepath.Join(t.TempDir(), "result.json")
+	output := RunOutput{
+		RunID:          "run-1",
+		RunURL:         "https://app.terraform.io/app/organization/workspaces/workspace/runs/run-1",
+		HasChanges:     tfe.Bool(true),
+		ResourceCounts: &ResourceCounts{Add: 1, Change: 2},
+		Status:         tfe.RunApplied,
+	}
+
+	err := c.WriteResultFile(context.Background(), path, output, OutputOptions{})
+	assert.NoError(t, err)
+
+	bytes, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"run_id": "run-1",
+		"run_url": "https://app.terraform.io/app/organization/workspaces/workspace/runs/run-1",
+		"status": "applied",
+		"has_changes": true,
+		"resource_counts": {"add": 1, "change": 2, "destroy": 0},
+		"policy_checks": [
+			{"id": "polchk-1", "status": "passed", "passed": 3, "advisory_failed": 0, "soft_failed": 0, "hard_failed": 0}
+		],
+		"cost": {"proposed_monthly_cost": "12.50", "delta_monthly_cost": "2.50"},
+		"duration_seconds": 90,
+		"outputs": {"endpoint": "https://example.com", "password": "***"}
+	}`, string(bytes))
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	var calls []string
+	var results []Result
+	failures := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var result Result
+		json.NewDecoder(r.Body).Decode(&result)
+		results = append(results, result)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(&tfe.Client{
+		Runs:          &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplied)}},
+		PolicyChecks:  &fakePolicyChecks{},
+		StateVersions: &fakeStateVersions{},
+	})
+	options := WebhookOptions{
+		SuccessURL: srv.URL + "/success",
+		FailureURL: srv.URL + "/failure",
+		Interval:   time.Millisecond,
+	}
+	output := RunOutput{RunID: "run-1", Status: tfe.RunApplied}
+
+	err := c.NotifyWebhook(context.Background(), options, output, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/success", "/success"}, calls, "failed request must be retried")
+	assert.Equal(t, tfe.RunApplied, results[0].Status)
+	assert.Empty(t, results[0].Error)
+
+	calls, results = nil, nil
+	output = RunOutput{RunID: "run-1", Status: tfe.RunErrored}
+
+	err = c.NotifyWebhook(context.Background(), options, output, ErrApplyErrored)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/failure"}, calls)
+	assert.Equal(t, ErrApplyErrored.Error(), results[0].Error)
+
+	t.Run("no webhook", func(t *testing.T) {
+		calls = nil
+
+		err := c.NotifyWebhook(context.Background(), WebhookOptions{SuccessURL: srv.URL + "/success"}, output, ErrApplyErrored)
+
+		assert.NoError(t, err)
+		assert.Empty(t, calls)
+	})
+
+	t.Run("client error", func(t *testing.T) {
+		calls = nil
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+
+		err := c.NotifyWebhook(context.Background(), WebhookOptions{SuccessURL: srv.URL, Interval: time.Millisecond}, RunOutput{Status: tfe.RunApplied}, nil)
+
+		assert.ErrorContains(t, err, "400 Bad Request")
+		assert.Len(t, calls, 1, "client errors must not be retried")
+	})
+
+	t.Run("unfinished run", func(t *testing.T) {
+		calls = nil
+
+		err := c.NotifyWebhook(context.Background(), options, RunOutput{RunID: "run-1", Status: tfe.RunPlanned}, nil)
+
+		assert.NoError(t, err)
+		assert.Empty(t, calls, "only finished runs are successful")
+	})
+}
+
+func TestReadCurrentState_cached(t *testing.T) {
+	stateVersions := &fakeStateVersions{state: testState}
+	c := newTestClient(&tfe.Client{StateVersions: stateVersions})
+
+	for i := 0; i < 2; i++ {
+		state, err := c.readCurrentState(context.Background())
+		assert.NoError(t, err)
+		assert.NotEmpty(t, state.Outputs)
+	}
+	assert.Equal(t, 1, stateVersions.downloads, "state versions must only be downloaded once")
+}
+
+func TestRun_appliedAt(t *testing.T) {
+	appliedAt := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	applied := testRun(tfe.RunApplied)
+	applied.StatusTimestamps = &tfe.RunStatusTimestamps{AppliedAt: appliedAt}
+	c := newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{applied}}})
+
+	output, err := c.Run(context.Background(), RunOptions{Type: RunTypeApply, WaitForCompletion: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t, &appliedAt, output.AppliedAt)
+
+	c = newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlannedAndFinished)}}})
+
+	output, err = c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true})
+
+	assert.NoError(t, err)
+	assert.Nil(t, output.AppliedAt)
+}
+
+func TestSummary(t *testing.T) {
+	c := newTestClient(&tfe.Client{})
+
+	output := RunOutput{RunURL: "https://example.com/run"}
+	assert.Equal(t, "Queued run in workspace — https://example.com/run", c.Summary(output))
+
+	output.Status = tfe.RunErrored
+	output.ResourceCounts = &ResourceCounts{Add: 1, Destroy: 2}
+	assert.Equal(t, "Run errored in workspace — https://example.com/run", c.Summary(output))
+
+	output.Status = tfe.RunPlannedAndFinished
+	assert.Equal(t, "Planned 1 add / 0 change / 2 destroy in workspace — https://example.com/run", c.Summary(output))
+}
+
+func TestResourceCounts_String(t *testing.T) {
+	assert.Equal(t, "3/1/0", ResourceCounts{Add: 3, Change: 1}.String())
+	assert.Equal(t, "0/0/12", ResourceCounts{Destroy: 12}.String())
+}
+
+func TestStatusMessages(t *testing.T) {
+	c := newTestClient(&tfe.Client{})
+	c.StatusMessages = map[tfe.RunStatus]string{
+		tfe.RunErrored:            "fehlgeschlagen",
+		tfe.RunPlannedAndFinished: "Geplant",
+	}
+
+	assert.Equal(t, "fehlgeschlagen", c.prettyPrint(tfe.RunErrored))
+	assert.Equal(t, "policy checked", c.prettyPrint(tfe.RunPolicyChecked))
+
+	output := RunOutput{RunURL: "https://example.com/run", Status: tfe.RunPlannedAndFinished}
+	assert.Equal(t, "Geplant in workspace — https://example.com/run", c.Summary(output))
+
+	assert.Equal(t, "errored", newTestClient(&tfe.Client{}).prettyPrint(tfe.RunErrored), "messages must not leak into other clients")
+}
+
+func TestWriteStatusOutputs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outputs")
+	t.Setenv("GITHUB_OUTPUT", path)
+
+	newTestClient(&tfe.Client{}).writeStatusOutputs(tfe.RunPlannedAndFinished)
+
+	bytes, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(bytes), "run-status<<_GitHubActionsFileCommandDelimeter_\nplanned_and_finished\n")
+	assert.Contains(t, string(bytes), "run-status-pretty<<_GitHubActionsFileCommandDelimeter_\nplanned and finished\n")
+}
+
+func TestEnumInputDefaults(t *testing.T) {
+	assert.Equal(t, RunTypeApply, asRunType(""))
+	assert.Equal(t, MissingStateWarn, asMissingStateBehavior(""))
+	assert.Equal(t, CancelFail, asCancelBehavior(""))
+	assert.Equal(t, StageFull, asStage(""))
+	assert.Equal(t, PolicyOverrideWait, asPolicyOverrideBehavior(""))
+	assert.Equal(t, EmptyApplySucceed, asEmptyApplyBehavior(""))
+	assert.Equal(t, FixedPollStrategy{Interval: pollInterval, Timeout: time.Hour}, asPollStrategy("", time.Hour))
+}
+
+func TestResolveToken(t *testing.T) {
+	_, err := resolveToken("", "")
+	assert.Error(t, err)
+
+	token, err := resolveToken("input-token", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "input-token", token)
+
+	path := filepath.Join(t.TempDir(), "token")
+	err = os.WriteFile(path, []byte("  file-token\n"), 0600)
+	assert.NoError(t, err)
+
+	token, err = resolveToken("input-token", path)
+	assert.NoError(t, err)
+	assert.Equal(t, "file-token", token, "token-file must take precedence")
+
+	_, err = resolveToken("input-token", filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorContains(t, err, "could not read token-file")
+
+	err = os.WriteFile(path, []byte("\n"), 0600)
+	assert.NoError(t, err)
+	_, err = resolveToken("", path)
+	assert.ErrorContains(t, err, "is empty")
+}
+
+func TestResolveOrganization(t *testing.T) {
+	t.Setenv("TFE_ORG", "")
+	t.Setenv("TF_ORGANIZATION", "")
+
+	_, err := resolveOrganization("")
+	assert.Error(t, err)
+
+	t.Setenv("TF_ORGANIZATION", "tf-org")
+	org, err := resolveOrganization("")
+	assert.NoError(t, err)
+	assert.Equal(t, "tf-org", org)
+
+	t.Setenv("TFE_ORG", "tfe-org")
+	org, err = resolveOrganization("")
+	assert.NoError(t, err)
+	assert.Equal(t, "tfe-org", org)
+
+	org, err = resolveOrganization("input-org")
+	assert.NoError(t, err)
+	assert.Equal(t, "input-org", org)
+}
+
+const testPlanLogs = `Terraform v1.9.0
+{"@level":"info","@message":"Terraform 1.9.0","type":"version"}
+{"@level":"warn","@message":"Warning: Argument is deprecated","type":"diagnostic","diagnostic":{"severity":"warning","summary":"Argument is deprecated","detail":"Use foo instead.","address":"null_resource.single"}}
+{"@level":"error","@message":"Error: Invalid value","type":"diagnostic","diagnostic":{"severity":"error","summary":"Invalid value"}}
+{"@level":"warn","@message":"Warning: Resource targeting is in effect","type":"diagnostic","diagnostic":{"severity":"warning","summary":"Resource targeting is in effect"}}
+`
+
+func TestRun_annotatePlanWarnings(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlannedAndFinished)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{logs: testPlanLogs},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:                 RunTypePlan,
+		WaitForCompletion:    true,
+		AnnotatePlanWarnings: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, output.PlanWarnings, 2)
+	assert.Equal(t, "Argument is deprecated", output.PlanWarnings[0].Summary)
+	assert.Equal(t, "null_resource.single: Use foo instead.", output.PlanWarnings[0].message())
+	assert.Equal(t, "Resource targeting is in effect", output.PlanWarnings[1].message())
+}
+
+func TestRun_onCancel(t *testing.T) {
+	for _, behavior := range []CancelBehavior{CancelFail, CancelSucceed, CancelSkip} {
+		runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunCanceled)}}
+		c := newTestClient(&tfe.Client{Runs: runs})
+
+		output, err := c.Run(context.Background(), RunOptions{
+			Type:              RunTypePlan,
+			WaitForCompletion: true,
+			OnCancel:          behavior,
+		})
+
+		if behavior == CancelFail {
+			assert.EqualError(t, err, "run run-1 has been canceled")
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, tfe.RunCanceled, output.Status)
+	}
+}
+
+func TestRun_attachLatest(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanning), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:       runs,
+		Plans:      &fakePlans{json: testPlanJSON},
+		Workspaces: &fakeWorkspaces{workspace: &tfe.Workspace{ID: "ws-1", CurrentRun: &tfe.Run{ID: "run-1"}}},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		AttachLatest:      true,
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, runs.created)
+	assert.Equal(t, "run-1", output.RunID)
+	assert.Equal(t, tfe.RunApplied, output.Status)
+}
+
+func TestRun_attachLatestNoActiveRun(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplied)}}
+
+	for _, w := range []*tfe.Workspace{
+		{ID: "ws-1"},
+		{ID: "ws-1", CurrentRun: &tfe.Run{ID: "run-1"}},
+	} {
+		c := newTestClient(&tfe.Client{
+			Runs:       runs,
+			Workspaces: &fakeWorkspaces{workspace: w},
+		})
+
+		_, err := c.Run(context.Background(), RunOptions{AttachLatest: true})
+
+		assert.ErrorIs(t, err, ErrNoActiveRun)
+		assert.Empty(t, runs.created)
+	}
+}
+
+const testNestedState = `{
+  "outputs": {
+    "endpoint": {"value": "https://example.com", "type": "string"},
+    "database": {"value": {"host": "db.example.com", "port": 5432, "tags": ["a"]}, "type": ["object", {}]}
+  }
+}`
+
+func TestGetTerraformOutputs_retryAfterApply(t *testing.T) {
+	stateVersions := &fakeStateVersions{state: testState, notFound: 1}
+	c := newTestClient(&tfe.Client{StateVersions: stateVersions})
+
+	outputs, err := c.GetTerraformOutputs(context.Background(), OutputOptions{
+		OnMissingState: MissingStateFail,
+		AppliedRunID:   "run-1",
+		ReadInterval:   time.Millisecond,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `"https://example.com"`, outputs["endpoint"])
+	assert.Equal(t, 2, stateVersions.reads)
+}
+
+func TestGetTerraformOutputs_retryAfterApplyStale(t *testing.T) {
+	stateVersions := &fakeStateVersions{state: testState}
+	c := newTestClient(&tfe.Client{StateVersions: stateVersions})
+
+	outputs, err := c.GetTerraformOutputs(context.Background(), OutputOptions{
+		AppliedRunID: "run-2",
+		ReadInterval: time.Millisecond,
+	})
+
+	assert.NoError(t, err)
+	assert.Contains(t, outputs, "endpoint")
+	assert.Equal(t, defaultReadAttempts, stateVersions.reads)
+}
+
+func TestGetTerraformOutputs_readAttempts(t *testing.T) {
+	stateVersions := &fakeStateVersions{}
+	c := newTestClient(&tfe.Client{StateVersions: stateVersions})
+
+	start := time.Now()
+	_, err := c.GetTerraformOutputs(context.Background(), OutputOptions{
+		OnMissingState: MissingStateFail,
+		AppliedRunID:   "run-1",
+		ReadAttempts:   3,
+		ReadInterval:   20 * time.Millisecond,
+	})
+
+	assert.ErrorIs(t, err, ErrNoState)
+	assert.Equal(t, 3, stateVersions.reads)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestGetTerraformOutputs_flatten(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		StateVersions: &fakeStateVersions{state: testNestedState},
+	})
+
+	outputs, err := c.GetTerraformOutputs(context.Background(), OutputOptions{Flatten: []string{"database"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `"db.example.com"`, outputs["database-host"])
+	assert.Equal(t, "5432", outputs["database-port"])
+	assert.Equal(t, `["a"]`, outputs["database-tags"])
+	assert.Equal(t, `"https://example.com"`, outputs["endpoint"])
+	assert.Contains(t, outputs, "database")
+}
+
+func TestGetTerraformOutputs_flattenNotAnObject(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		StateVersions: &fakeStateVersions{state: testNestedState},
+	})
+
+	_, err := c.GetTerraformOutputs(context.Background(), OutputOptions{Flatten: []string{"endpoint"}})
+	assert.EqualError(t, err, "could not flatten output endpoint: not an object")
+
+	_, err = c.GetTerraformOutputs(context.Background(), OutputOptions{Flatten: []string{"missing"}})
+	assert.EqualError(t, err, "could not flatten output missing: not an object")
+}
+
+func TestNewClient(t *testing.T) {
+	w := &tfe.Workspace{ID: "ws-1", Name: "workspace"}
+	c, err := newClient(context.Background(), &tfe.Client{
+		Organizations: &fakeOrganizations{},
+		Workspaces:    &fakeWorkspaces{workspace: w},
+	}, ClientConfig{Organization: "organization", Workspace: "workspace"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, w, c.workspace)
+}
+
+func TestNewClient_retryWorkspaceRead(t *testing.T) {
+	w := &tfe.Workspace{ID: "ws-1", Name: "workspace"}
+	workspaces := &fakeWorkspaces{workspace: w, readErrs: []error{errors.New("connection reset by peer")}}
+	cfg := ClientConfig{
+		Organization:          "organization",
+		Workspace:             "workspace",
+		WorkspaceReadInterval: time.Millisecond,
+	}
+
+	c, err := newClient(context.Background(), &tfe.Client{
+		Organizations: &fakeOrganizations{},
+		Workspaces:    workspaces,
+	}, cfg)
+
+	assert.NoError(t, err)
+	assert.Equal(t, w, c.workspace)
+	assert.Equal(t, 2, workspaces.reads)
+
+	t.Run("not found", func(t *testing.T) {
+		workspaces := &fakeWorkspaces{workspace: w, readErrs: []error{tfe.ErrResourceNotFound}}
+
+		_, err := newClient(context.Background(), &tfe.Client{
+			Organizations: &fakeOrganizations{},
+			Workspaces:    workspaces,
+		}, cfg)
+
+		assert.ErrorIs(t, err, tfe.ErrResourceNotFound)
+		assert.Equal(t, 1, workspaces.reads, "not found must not be retried")
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		cfg := cfg
+		cfg.WorkspaceReadAttempts = 2
+		workspaces := &fakeWorkspaces{workspace: w, readErrs: []error{
+			errors.New("connection reset by peer"),
+			errors.New("connection refused"),
+		}}
+
+		_, err := newClient(context.Background(), &tfe.Client{
+			Organizations: &fakeOrganizations{},
+			Workspaces:    workspaces,
+		}, cfg)
+
+		assert.EqualError(t, err, "could not retrieve workspace 'organization/workspace': connection refused")
+		assert.Equal(t, 2, workspaces.reads)
+	})
+}
+
+func TestNewClient_uiAddress(t *testing.T) {
+	w := &tfe.Workspace{ID: "ws-1", Name: "workspace", Organization: &tfe.Organization{Name: "organization"}}
+	tfeClient := &tfe.Client{
+		Organizations: &fakeOrganizations{},
+		Workspaces:    &fakeWorkspaces{workspace: w},
+		Runs:          &fakeRuns{},
+	}
+	c, err := newClient(context.Background(), tfeClient, ClientConfig{
+		Organization: "organization",
+		Workspace:    "workspace",
+		Address:      "https://tfe-api.internal",
+		UIAddress:    "https://tfe.example.com/",
+	})
+	assert.NoError(t, err)
+
+	output, err := c.Run(context.Background(), RunOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://tfe.example.com/app/organization/workspaces/workspace/runs/run-1", output.RunURL)
+
+	c, err = newClient(context.Background(), tfeClient, ClientConfig{
+		Organization: "organization",
+		Workspace:    "workspace",
+		Address:      "https://tfe-api.internal",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://tfe-api.internal/app/organization/workspaces/workspace/runs/run-1", c.runURL("run-1"))
+}
+
+func TestNewHTTPClient_proxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+
+	client, err := newHTTPClient(proxy.URL)
+	assert.NoError(t, err)
+
+	resp, err := client.Get("http://tfe.example.com/api/v2/ping")
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"http://tfe.example.com/api/v2/ping"}, proxied)
+}
+
+// newAssessmentClient returns a Client whose API only serves the given
+// current assessment result, or 404 if it is empty.
+func newAssessmentClient(t *testing.T, assessment string) *Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/workspaces/ws-1/current-assessment-result" || assessment == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		fmt.Fprint(w, assessment)
+	}))
+	t.Cleanup(srv.Close)
+
+	tfeClient, err := tfe.NewClient(&tfe.Config{Address: srv.URL, Token: "token"})
+	assert.NoError(t, err)
+	return newTestClient(tfeClient)
+}
+
+const testAssessment = `{"data": {
+  "id": "asmtres-1",
+  "type": "assessment-results",
+  "attributes": {"drifted": true, "succeeded": true, "error-msg": null, "created-at": "2024-05-01T12:00:00.000Z"}
+}}`
+
+func TestGetAssessmentResult(t *testing.T) {
+	c := newAssessmentClient(t, testAssessment)
+
+	result, err := c.GetAssessmentResult(context.Background(), AssessmentOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "asmtres-1", result.ID)
+	assert.True(t, result.Drifted)
+	assert.True(t, result.Succeeded)
+}
+
+func TestGetAssessmentResult_failOnDrift(t *testing.T) {
+	c := newAssessmentClient(t, testAssessment)
+
+	result, err := c.GetAssessmentResult(context.Background(), AssessmentOptions{FailOnDrift: true})
+
+	assert.ErrorIs(t, err, ErrDriftDetected)
+	assert.EqualError(t, err, "health assessment detected drift, assessment asmtres-1 from 2024-05-01T12:00:00Z")
+	assert.True(t, result.Drifted)
+}
+
+func TestGetAssessmentResult_noAssessment(t *testing.T) {
+	c := newAssessmentClient(t, "")
+
+	_, err := c.GetAssessmentResult(context.Background(), AssessmentOptions{FailOnDrift: true})
+
+	assert.ErrorIs(t, err, ErrNoAssessment)
+}
+
+func TestNewClient_retryOrganizationRead(t *testing.T) {
+	w := &tfe.Workspace{ID: "ws-1", Name: "workspace"}
+	organizations := &fakeOrganizations{readErrs: []error{errors.New("connection reset by peer")}}
+
+	c, err := newClient(context.Background(), &tfe.Client{
+		Organizations: organizations,
+		Workspaces:    &fakeWorkspaces{workspace: w},
+	}, ClientConfig{Organization: "organization", Workspace: "workspace", WorkspaceReadInterval: time.Millisecond})
+
+	assert.NoError(t, err)
+	assert.Equal(t, w, c.workspace)
+	assert.Equal(t, 2, organizations.reads)
+}
+
+func TestNewClient_organizationNotReadable(t *testing.T) {
+	w := &tfe.Workspace{ID: "ws-1", Name: "workspace"}
+
+	c, err := newClient(context.Background(), &tfe.Client{
+		Organizations: &fakeOrganizations{err: tfe.ErrResourceNotFound},
+		Workspaces:    &fakeWorkspaces{workspace: w},
+	}, ClientConfig{Organization: "organization", Workspace: "workspace"})
+
+	assert.NoError(t, err, "workspace scoped tokens must be accepted")
+	assert.Equal(t, w, c.workspace)
+}
+
+func TestNewClient_invalidToken(t *testing.T) {
+	_, err := newClient(context.Background(), &tfe.Client{
+		Organizations: &fakeOrganizations{err: tfe.ErrUnauthorized},
+	}, ClientConfig{Organization: "organization", Workspace: "workspace"})
+
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestCheck(t *testing.T) {
+	// Only the read calls are faked, any other call panics
+	w := &tfe.Workspace{
+		ID:           "ws-1",
+		Name:         "workspace",
+		Organization: &tfe.Organization{Name: "organization"},
+		Permissions:  &tfe.WorkspacePermissions{CanQueueRun: true, CanQueueApply: true},
+	}
+	c, err := newClient(context.Background(), &tfe.Client{
+		Organizations: &fakeOrganizations{},
+		Workspaces:    &fakeWorkspaces{workspace: w},
+		Runs:          &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning)}},
+		ConfigurationVersions: &fakeConfigurationVersions{pages: [][]*tfe.ConfigurationVersion{
+			{testConfigurationVersion("cv-1", tfe.ConfigurationUploaded, "a1b2c3d", "v1.1.0")},
+		}},
+	}, ClientConfig{Organization: "organization", Workspace: "workspace"})
+	assert.NoError(t, err)
+
+	err = c.Check(context.Background(), RunOptions{Type: RunTypeApply, ConfigurationVersion: "v1.1.0", ResumeRunID: "run-1"})
+
+	assert.NoError(t, err)
+	assert.Empty(t, c.client.Runs.(*fakeRuns).created)
+}
+
+func TestCheck_missingPermissions(t *testing.T) {
+	c := newTestClient(&tfe.Client{})
+	c.workspace.Permissions = &tfe.WorkspacePermissions{CanQueueRun: true}
+
+	err := c.Check(context.Background(), RunOptions{Type: RunTypeDestroy})
+
+	assert.EqualError(t, err, "token is not allowed to queue destroy runs on workspace workspace")
+}
+
+func TestGetWorkspaceSettings(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Workspaces: &fakeWorkspaces{workspace: &tfe.Workspace{
+			ID:                  "ws-1",
+			AutoApply:           true,
+			AutoApplyRunTrigger: true,
+			TerraformVersion:    "1.9.5",
+			ExecutionMode:       "remote",
+			WorkingDirectory:    "infra",
+		}},
+	})
+
+	settings, err := c.GetWorkspaceSettings(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"id":                     "ws-1",
+		"auto-apply":             "true",
+		"auto-apply-run-trigger": "true",
+		"terraform-version":      "1.9.5",
+		"execution-mode":         "remote",
+		"working-directory":      "infra",
+		"locked":                 "false",
+	}, settings)
+}
+
+func TestExportedOutputs(t *testing.T) {
+	outputs := map[string]string{
+		"endpoint": "https://example.com",
+		"db-host":  "db.example.com",
+		"db-port":  "5432",
+	}
+
+	assert.Equal(t, outputs, exportedOutputs(outputs, nil))
+	assert.Equal(t, map[string]string{
+		"endpoint": "https://example.com",
+		"db-host":  "db.example.com",
+	}, exportedOutputs(outputs, []string{"endpoint", "db-host", "missing"}))
+	assert.Empty(t, exportedOutputs(outputs, []string{"db"}))
+}
+
+func TestActionDefaults(t *testing.T) {
+	defaults, err := actionDefaults()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "apply", defaults["type"])
+	assert.Equal(t, "true", defaults["wait-for-completion"])
+	assert.Equal(t, "", defaults["targets"])
+}
+
+func TestDevelopmentEnvFile(t *testing.T) {
+	doc, err := os.ReadFile(filepath.Join("doc", "development.md"))
+	assert.NoError(t, err)
+	_, example, _ := strings.Cut(string(doc), "```\n")
+	example, _, _ = strings.Cut(example, "```")
+	path := filepath.Join(t.TempDir(), ".env")
+	assert.NoError(t, os.WriteFile(path, []byte(example), 0600))
+
+	environ := os.Environ()
+	t.Cleanup(func() {
+		os.Clearenv()
+		for _, env := range environ {
+			key, value, _ := strings.Cut(env, "=")
+			os.Setenv(key, value)
+		}
+	})
+
+	err = gha.LoadEnvFile(path)
+	assert.NoError(t, err)
+	defaults, err := actionDefaults()
+	assert.NoError(t, err)
+	gha.SetDefaultInputs(defaults)
+
+	var in input
+	err = gha.PopulateFromInputs(&in)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "my-workspace", in.Workspace)
+	assert.Equal(t, "plan", in.Type)
+	assert.True(t, in.WaitForCompletion)
+	assert.Equal(t, 2*time.Second, in.InitialPollDelay)
+	assert.Equal(t, 5, in.OutputReadAttempts)
+
+	_, err = resolveSettings(in)
+	assert.NoError(t, err)
+}
+
+func TestReadInputs_gitLabCI(t *testing.T) {
+	environ := os.Environ()
+	t.Cleanup(func() {
+		os.Clearenv()
+		for _, env := range environ {
+			key, value, _ := strings.Cut(env, "=")
+			os.Setenv(key, value)
+		}
+	})
+	os.Clearenv()
+	os.Setenv("GITLAB_CI", "true")
+	os.Setenv("INPUT_WORKSPACE", "my-workspace")
+
+	in, _, err := readInputs(false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "my-workspace", in.Workspace)
+	assert.Equal(t, "apply", in.Type)
+	assert.True(t, in.WaitForCompletion)
+
+	_, err = resolveSettings(in)
+	assert.NoError(t, err)
+}
+
+func TestAutoCommentTemplate(t *testing.T) {
+	body, err := renderTemplate(autoCommentTemplate, gha.Metadata{
+		CI:         "GitHub Actions",
+		Repository: "octocat/Hello-World",
+		Commit:     "ffac537e6cbbf934b08745a378932722df287a53",
+		Ref:        "refs/heads/main",
+		Actor:      "octocat",
+		Workflow:   "CI",
+		JobURL:     "https://github.com/octocat/Hello-World/actions/runs/1658821493",
+	})
+
+	assert.NoError(t, err)
+	assert.Contains(t, body, "Queued by GitHub Actions, triggered by octocat.")
+	assert.Contains(t, body, "octocat/Hello-World@ffac537e6cbbf934b08745a378932722df287a53 (refs/heads/main)")
+	assert.Contains(t, body, "Workflow: CI")
+	assert.Contains(t, body, "CI job: https://github.com/octocat/Hello-World/actions/runs/1658821493")
+}
+
+func TestAutoCommentTemplate_pullRequest(t *testing.T) {
+	body, err := renderTemplate(autoCommentTemplate, gha.Metadata{
+		Repository: "octocat/Hello-World",
+		Commit:     "ffac537e6cbbf934b08745a378932722df287a53",
+		PullRequest: gha.PullRequest{
+			Number: 42,
+			Title:  "Add staging environment",
+			Author: "octocat",
+		},
+	})
+
+	assert.NoError(t, err)
+	assert.Contains(t, body, "octocat/Hello-World@ffac537e6cbbf934b08745a378932722df287a53\n- Pull request: #42 Add staging environment by octocat\n- Workflow:")
+}
+
+func TestAutoCommentTemplate_gitLab(t *testing.T) {
+	body, err := renderTemplate(autoCommentTemplate, gha.Metadata{
+		CI:          "GitLab CI",
+		Repository:  "octocat/hello-world",
+		Commit:      "ffac537e6cbbf934b08745a378932722df287a53",
+		PullRequest: gha.PullRequest{Number: 42, Title: "Add staging environment"},
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(body, "Queued by GitLab CI."), body)
+	assert.Contains(t, body, "- Pull request: #42 Add staging environment\n")
+}
+
+func TestMessageTemplate(t *testing.T) {
+	metadata := gha.Metadata{PullRequest: gha.PullRequest{Number: 42, Title: "Add staging environment"}}
+
+	message, err := renderTemplate("#{{.PullRequest.Number}} {{.PullRequest.Title}}", metadata)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "#42 Add staging environment", message)
+
+	message, err = renderTemplate("{{if .PullRequest.Number}}#{{.PullRequest.Number}}{{else}}push{{end}}", gha.Metadata{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "push", message)
+}
+
+func TestRun_comment(t *testing.T) {
+	comments := &fakeComments{}
+	c := newTestClient(&tfe.Client{
+		Runs:     &fakeRuns{},
+		Comments: comments,
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{Comment: tfe.String("Hello")})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Hello"}, comments.bodies)
+}
+
+func TestRun_description(t *testing.T) {
+	runs := &fakeRuns{}
+	comments := &fakeComments{}
+	c := newTestClient(&tfe.Client{
+		Runs:     runs,
+		Comments: comments,
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Message:     tfe.String("Add staging environment"),
+		Description: tfe.String("Creates the staging VPC and database."),
+		Comment:     tfe.String("Queued by GitHub Actions."),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Add staging environment", *runs.created[0].Message)
+	assert.Equal(t, []string{"Creates the staging VPC and database.", "Queued by GitHub Actions."}, comments.bodies)
+}
+
+func TestRun_createdBy(t *testing.T) {
+	runs := &fakeRuns{
+		reads:     []*tfe.Run{testRun(tfe.RunPlanning)},
+		createdBy: &tfe.User{ID: "user-1", Username: "octocat"},
+	}
+	c := newTestClient(&tfe.Client{Runs: runs, Workspaces: &fakeWorkspaces{workspace: &tfe.Workspace{ID: "ws-1", CurrentRun: &tfe.Run{ID: "run-1"}}}})
+
+	output, err := c.Run(context.Background(), RunOptions{AttachLatest: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "octocat", output.CreatedBy)
+}
+
+func TestRun_reusedExistingRun(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Runs:       &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning)}},
+		Workspaces: &fakeWorkspaces{workspace: &tfe.Workspace{ID: "ws-1", CurrentRun: &tfe.Run{ID: "run-1"}}},
+	})
+
+	for _, options := range []RunOptions{
+		{AttachLatest: true},
+		{ResumeRunID: "run-1"},
+	} {
+		output, err := c.Run(context.Background(), options)
+
+		assert.NoError(t, err)
+		assert.True(t, output.ReusedExistingRun)
+	}
+
+	output, err := c.Run(context.Background(), RunOptions{})
+
+	assert.NoError(t, err)
+	assert.False(t, output.ReusedExistingRun)
+}
+
+func TestRun_targetedDestroy(t *testing.T) {
+	runs := &fakeRuns{}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:                     RunTypeDestroy,
+		TargetAddrs:              []string{"module.cache"},
+		RequireTargetsForDestroy: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.Bool(true), runs.created[0].IsDestroy)
+	assert.Equal(t, []string{"module.cache"}, runs.created[0].TargetAddrs)
+}
+
+func TestRun_requireTargetsForDestroy(t *testing.T) {
+	runs := &fakeRuns{}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{Type: RunTypeDestroy, RequireTargetsForDestroy: true})
+
+	assert.ErrorIs(t, err, ErrUntargetedDestroy)
+	assert.Empty(t, runs.created)
+
+	_, err = c.Run(context.Background(), RunOptions{Type: RunTypeApply, RequireTargetsForDestroy: true})
+
+	assert.NoError(t, err)
+}
+
+func TestRun_reason(t *testing.T) {
+	runs := &fakeRuns{}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{Message: tfe.String("Nightly check"), Reason: "scheduled-drift"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "[scheduled-drift] Nightly check", *runs.created[0].Message)
+}
+
+func TestRun_optionsMutator(t *testing.T) {
+	runs := &fakeRuns{}
+	c := newTestClient(&tfe.Client{Runs: runs})
+	c.OptionsMutator = func(options *RunOptions) {
+		options.Message = tfe.String("Mutated")
+		options.TargetAddrs = append(options.TargetAddrs, "module.app")
+	}
+
+	_, err := c.Run(context.Background(), RunOptions{Message: tfe.String("Original")})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Mutated", *runs.created[0].Message)
+	assert.Equal(t, []string{"module.app"}, runs.created[0].TargetAddrs)
+}
+
+type fakeConfigurationVersions struct {
+	tfe.ConfigurationVersions
+	pages [][]*tfe.ConfigurationVersion
+}
+
+func (f *fakeConfigurationVersions) List(ctx context.Context, workspaceID string, options *tfe.ConfigurationVersionListOptions) (*tfe.ConfigurationVersionList, error) {
+	page := options.PageNumber
+	if page == 0 {
+		page = 1
+	}
+	list := &tfe.ConfigurationVersionList{
+		Items:      f.pages[page-1],
+		Pagination: &tfe.Pagination{CurrentPage: page},
+	}
+	if page < len(f.pages) {
+		list.Pagination.NextPage = page + 1
+	}
+	return list, nil
+}
+
+func testConfigurationVersion(id string, status tfe.ConfigurationStatus, commitSHA, tag string) *tfe.ConfigurationVersion {
+	return &tfe.ConfigurationVersion{
+		ID:                id,
+		Status:            status,
+		IngressAttributes: &tfe.IngressAttributes{CommitSHA: commitSHA, Tag: tag},
+	}
+}
+
+func TestResolveConfigurationVersion(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		ConfigurationVersions: &fakeConfigurationVersions{pages: [][]*tfe.ConfigurationVersion{
+			{
+				testConfigurationVersion("cv-4", tfe.ConfigurationErrored, "d4e5f6a", "v1.2.0"),
+				testConfigurationVersion("cv-3", tfe.ConfigurationUploaded, "c3d4e5f6a7b8", ""),
+			},
+			{
+				testConfigurationVersion("cv-2", tfe.ConfigurationUploaded, "b2c3d4e", "v1.2.0"),
+				testConfigurationVersion("cv-1", tfe.ConfigurationUploaded, "a1b2c3d", "v1.1.0"),
+			},
+		}},
+	})
+
+	for label, id := range map[string]string{
+		"cv-1":    "cv-1",
+		"v1.2.0":  "cv-2",
+		"c3d4e5f": "cv-3",
+	} {
+		cv, err := c.resolveConfigurationVersion(context.Background(), label)
+
+		assert.NoError(t, err)
+		assert.Equal(t, id, cv.ID, label)
+	}
+
+	_, err := c.resolveConfigurationVersion(context.Background(), "v2.0.0")
+	assert.ErrorIs(t, err, ErrNoConfigurationVersion)
+}
+
+func TestRun_configurationVersion(t *testing.T) {
+	runs := &fakeRuns{}
+	c := newTestClient(&tfe.Client{
+		Runs: runs,
+		ConfigurationVersions: &fakeConfigurationVersions{pages: [][]*tfe.ConfigurationVersion{
+			{testConfigurationVersion("cv-1", tfe.ConfigurationUploaded, "a1b2c3d", "v1.1.0")},
+		}},
+	})
+
+	_, err := c.Run(context.Background(), RunOptions{ConfigurationVersion: "v1.1.0"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "cv-1", runs.created[0].ConfigurationVersion.ID)
+}
+
+func TestReasonMessage(t *testing.T) {
+	assert.Nil(t, reasonMessage("", nil))
+	assert.Equal(t, "Deploy", *reasonMessage("", tfe.String("Deploy")))
+	assert.Equal(t, "[hotfix]", *reasonMessage("hotfix", nil))
+}
+
+func TestGetTerraformOutputs_waitForState(t *testing.T) {
+	stateVersions := &fakeStateVersions{state: testState, notReady: 2}
+	c := newTestClient(&tfe.Client{StateVersions: stateVersions})
+
+	outputs, err := c.GetTerraformOutputs(context.Background(), OutputOptions{WaitForState: true})
+
+	assert.NoError(t, err)
+	assert.Contains(t, outputs, "endpoint")
+	// two unprocessed reads, one processed read and the read of the outputs
+	assert.Equal(t, 4, stateVersions.reads)
+}
+
+func TestGetTerraformOutputs_waitForStateTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { stateTimeout = timeout }(stateTimeout)
+	stateTimeout = 10 * time.Millisecond
+
+	c := newTestClient(&tfe.Client{StateVersions: &fakeStateVersions{}})
+
+	_, err := c.GetTerraformOutputs(context.Background(), OutputOptions{WaitForState: true})
+
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestResolveSettings(t *testing.T) {
+	s, err := resolveSettings(input{})
+	assert.NoError(t, err)
+	assert.Equal(t, settings{Timeout: time.Hour}, s)
+
+	s, err = resolveSettings(input{Profile: "dev"})
+	assert.NoError(t, err)
+	assert.Equal(t, settings{Timeout: 30 * time.Minute}, s)
+
+	s, err = resolveSettings(input{Profile: "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, settings{Timeout: 2 * time.Hour, RequireDestroyConfirmation: true}, s)
+
+	_, err = resolveSettings(input{Profile: "staging"})
+	assert.Error(t, err)
+}
+
+func TestResolveSettings_explicitInputsOverride(t *testing.T) {
+	s, err := resolveSettings(input{Profile: "prod", Timeout: "45m", RequireDestroyConfirmation: "false"})
+	assert.NoError(t, err)
+	assert.Equal(t, settings{Timeout: 45 * time.Minute}, s)
+
+	_, err = resolveSettings(input{Timeout: "forever"})
+	assert.Error(t, err)
+}
+
+func TestRun_discarded(t *testing.T) {
+	tests := []struct {
+		events []*tfe.RunEvent
+		reason string
+	}{
+		{
+			events: []*tfe.RunEvent{
+				{Action: "queued"},
+				{Action: "discarded", Actor: &tfe.User{Username: "octocat"}, Comment: &tfe.Comment{Body: "not needed"}},
+			},
+			reason: `run run-1 has been discarded by octocat with comment "not needed"`,
+		},
+		{
+			events: []*tfe.RunEvent{{Action: "discarded"}},
+			reason: "run run-1 has been discarded automatically, it was probably superseded by a newer run",
+		},
+		{
+			reason: "run run-1 has been discarded",
+		},
+	}
+
+	for _, test := range tests {
+		runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunDiscarded)}}
+		c := newTestClient(&tfe.Client{
+			Runs:      runs,
+			RunEvents: &fakeRunEvents{events: test.events},
+		})
+
+		_, err := c.Run(context.Background(), RunOptions{
+			Type:              RunTypePlan,
+			WaitForCompletion: true,
+		})
+
+		assert.EqualError(t, err, test.reason)
+	}
+}
+
+func TestCompactWarnings(t *testing.T) {
+	warnings := []Diagnostic{
+		{Severity: "warning", Summary: "Argument is deprecated", Detail: "Use foo instead.", Address: "null_resource.a"},
+		{Severity: "warning", Summary: "Resource targeting is in effect", Detail: "Be careful."},
+		{Severity: "warning", Summary: "Argument is deprecated", Detail: "Use foo instead.", Address: "null_resource.b"},
+		{Severity: "warning", Summary: "Argument is deprecated", Detail: "Use foo instead.", Address: "null_resource.c"},
+	}
+
+	compacted := compactWarnings(warnings)
+
+	assert.Equal(t, []Diagnostic{
+		{Severity: "warning", Summary: "3 warnings: Argument is deprecated", Detail: "Affected resources: null_resource.a, null_resource.b, null_resource.c"},
+		{Severity: "warning", Summary: "Resource targeting is in effect", Detail: "Be careful."},
+	}, compacted)
+}
+
+func TestRun_queueTimeout(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPending)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		QueueTimeout:      10 * time.Millisecond,
+		ExecutionTimeout:  time.Hour,
+	})
+
+	assert.ErrorIs(t, err, ErrQueueTimeout)
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.NotErrorIs(t, err, ErrExecutionTimeout)
+}
+
+func TestRun_executionTimeout(t *testing.T) {
+	reads := []*tfe.Run{}
+	for i := 0; i < 20; i++ {
+		reads = append(reads, testRun(tfe.RunPending))
+	}
+	reads = append(reads, testRun(tfe.RunPlanning))
+	runs := &fakeRuns{reads: reads}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		QueueTimeout:      time.Hour,
+		ExecutionTimeout:  10 * time.Millisecond,
+	})
+
+	assert.ErrorIs(t, err, ErrExecutionTimeout)
+	assert.NotErrorIs(t, err, ErrQueueTimeout)
+}
+
+// recreatedRuns returns the runs in recreatedReads once a second run has been
+// created.
+type recreatedRuns struct {
+	*fakeRuns
+	recreatedReads []*tfe.Run
+}
+
+func (f *recreatedRuns) Create(ctx context.Context, options tfe.RunCreateOptions) (*tfe.Run, error) {
+	if len(f.created) == 0 {
+		return f.fakeRuns.Create(ctx, options)
+	}
+	f.reads = f.recreatedReads
+	f.created = append(f.created, options)
+	return &tfe.Run{ID: "run-2", Status: tfe.RunPending, Plan: &tfe.Plan{ID: "plan-2"}, Apply: &tfe.Apply{ID: "apply-2"}}, nil
+}
+
+func TestRun_stuckStageTimeout(t *testing.T) {
+	var recreatedReads []*tfe.Run
+	for i := 0; i < 25; i++ {
+		recreatedReads = append(recreatedReads, testRun(tfe.RunPlanning))
+	}
+	runs := &recreatedRuns{
+		fakeRuns:       &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPrePlanRunning)}},
+		recreatedReads: append(recreatedReads, testRun(tfe.RunPlannedAndFinished)),
+	}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		StuckStageTimeout: 20 * time.Millisecond,
+		// Only exceeded if the time the stuck run took counts as well
+		ExecutionTimeout: 40 * time.Millisecond,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"run-1"}, runs.canceled)
+	assert.Len(t, runs.created, 2, "stuck run must be recreated")
+	assert.Equal(t, "run-2", output.RunID)
+	assert.Equal(t, "plan-2", output.PlanID)
+	assert.Equal(t, "https://app.terraform.io/app/organization/workspaces/workspace/runs/run-2", output.RunURL)
+	assert.Equal(t, output.RunURL+"/plans/plan-2", output.PlanURL)
+	assert.Equal(t, output.RunURL+"/applies/apply-2", output.ApplyURL)
+
+	t.Run("stuck again", func(t *testing.T) {
+		runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunFetching)}}
+		c := newTestClient(&tfe.Client{Runs: runs})
+
+		_, err := c.Run(context.Background(), RunOptions{
+			Type:              RunTypePlan,
+			WaitForCompletion: true,
+			StuckStageTimeout: 5 * time.Millisecond,
+		})
+
+		assert.ErrorIs(t, err, ErrStuckStage)
+		assert.Len(t, runs.canceled, 1)
+		assert.Len(t, runs.created, 2, "run must only be recreated once")
+	})
+}
+
+func TestResolveSettings_phaseTimeouts(t *testing.T) {
+	s, err := resolveSettings(input{QueueTimeout: "5m", ExecutionTimeout: "20m"})
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, s.QueueTimeout)
+	assert.Equal(t, 20*time.Minute, s.ExecutionTimeout)
+
+	_, err = resolveSettings(input{QueueTimeout: "soon"})
+	assert.EqualError(t, err, `could not parse queue-timeout: time: invalid duration "soon"`)
+}
+
+func TestGetTerraformOutputsJSON(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		StateVersions: &fakeStateVersions{state: `{
+  "outputs": {
+    "endpoint": {"value": "https://example.com", "type": "string"},
+    "password": {"value": "hunter2", "type": "string", "sensitive": true},
+    "ports": {"value": [80, 443], "type": ["tuple", ["number", "number"]]}
+  }
+}`},
+	})
+
+	outputs, err := c.GetTerraformOutputsJSON(context.Background(), OutputOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"endpoint":{"sensitive":false,"type":"string","value":"https://example.com"},`+
+		`"password":{"sensitive":true,"type":"string","value":"hunter2"},`+
+		`"ports":{"sensitive":false,"type":["tuple",["number","number"]],"value":[80,443]}}`, outputs)
+}
+
+func TestRun_skipDestroyIfEmpty(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{plan: &tfe.Plan{ID: "plan-1", ResourceDestructions: 0}},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:               RunTypeDestroy,
+		WaitForCompletion:  true,
+		SkipDestroyIfEmpty: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"run-1"}, runs.discarded)
+	assert.Equal(t, RunSkipped, output.Status)
+	assert.Equal(t, tfe.Bool(false), output.Applied)
+	assert.True(t, isSucceeded(output.Status), "skipped destroy runs are successful")
+	assert.Equal(t, "Skipped empty destroy in workspace — "+output.RunURL, c.Summary(output))
+
+	c.client.PolicyChecks = &fakePolicyChecks{}
+	c.client.StateVersions = &fakeStateVersions{}
+	result, err := c.GetResult(context.Background(), output, OutputOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, RunSkipped, result.Status)
+}
+
+func TestRun_skipDestroyIfEmptyWithDestructions(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{
+		Runs:  runs,
+		Plans: &fakePlans{plan: &tfe.Plan{ID: "plan-1", ResourceDestructions: 3}},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:               RunTypeDestroy,
+		WaitForCompletion:  true,
+		SkipDestroyIfEmpty: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, runs.discarded)
+	assert.Equal(t, tfe.RunApplied, output.Status)
+}
+
+func TestRun_onEmptyApply(t *testing.T) {
+	for behavior, wantErr := range map[EmptyApplyBehavior]bool{
+		EmptyApplySucceed: false,
+		EmptyApplyWarn:    false,
+		EmptyApplyFail:    true,
+	} {
+		c := newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlannedAndFinished)}}})
+
+		_, err := c.Run(context.Background(), RunOptions{
+			Type:              RunTypeApply,
+			WaitForCompletion: true,
+			OnEmptyApply:      behavior,
+		})
+
+		if wantErr {
+			assert.ErrorIs(t, err, ErrEmptyApply)
+			assert.EqualError(t, err, "plan has no changes to apply, run run-1")
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestRun_onEmptyApplyWithChanges(t *testing.T) {
+	r := testRun(tfe.RunPlannedAndFinished)
+	r.HasChanges = true
+	c := newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{r}}})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		OnEmptyApply:      EmptyApplyFail,
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestRun_stageFull(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		Stage:             StageFull,
+	})
+
+	assert.NoError(t, err)
+	assert.Nil(t, runs.created[0].AutoApply)
+	assert.Equal(t, tfe.RunApplied, output.Status)
+}
+
+func TestRun_stagePlan(t *testing.T) {
+	planned := testRun(tfe.RunCostEstimated)
+	planned.Actions.IsConfirmable = true
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanned), planned, testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+	c.workspace.AutoApply = false
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		Stage:             StagePlan,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.Bool(false), runs.created[0].AutoApply)
+	assert.Equal(t, "run-1", output.RunID)
+	assert.Equal(t, tfe.RunCostEstimated, output.Status)
+	assert.Equal(t, tfe.Bool(false), output.Applied)
+	assert.Len(t, runs.readTimes, 3)
+}
+
+func TestRun_stageApply(t *testing.T) {
+	planned := testRun(tfe.RunPlanned)
+	planned.ID = "run-2"
+	planned.Actions.IsConfirmable = true
+	runs := &fakeRuns{reads: []*tfe.Run{planned, testRun(tfe.RunApplying), testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+	c.workspace.AutoApply = false
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+		Stage:             StageApply,
+		ApplyRunID:        "run-2",
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, runs.created)
+	assert.Equal(t, []string{"run-2"}, runs.applied)
+	assert.Equal(t, tfe.RunApplied, output.Status)
+}
+
+func TestRun_stageApplyNotConfirmable(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplied)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{Stage: StageApply, ApplyRunID: "run-1"})
+
+	assert.EqualError(t, err, "run run-1 can not be applied, its status is applied")
+	assert.Empty(t, runs.applied)
+
+	_, err = c.Run(context.Background(), RunOptions{Stage: StageApply})
+
+	assert.EqualError(t, err, "the ID of the run to apply is required for stage apply")
+}
+
+func TestRun_maxPolls(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlanning), testRun(tfe.RunPlanning), testRun(tfe.RunPlannedAndFinished)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		MaxPolls:          2,
+	})
+
+	assert.ErrorIs(t, err, ErrMaxPolls)
+	assert.NotErrorIs(t, err, ErrTimeout)
+	assert.Contains(t, err.Error(), "(2), last status of run was planning")
+	assert.Len(t, runs.readTimes, 2)
+}
+
+func TestRun_maxPollsFinished(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlannedAndFinished)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		MaxPolls:          2,
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestRun_initialPollDelay(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlannedAndFinished)}}
+	c := newTestClient(&tfe.Client{Runs: runs})
+
+	start := time.Now()
+	_, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+		InitialPollDelay:  50 * time.Millisecond,
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, runs.readTimes, 1)
+	assert.GreaterOrEqual(t, runs.readTimes[0].Sub(start), 50*time.Millisecond)
+}
+
+func TestRun_applied(t *testing.T) {
+	for status, applied := range map[tfe.RunStatus]bool{
+		tfe.RunPlannedAndFinished: false,
+		tfe.RunApplied:            true,
+	} {
+		t.Run(string(status), func(t *testing.T) {
+			r := testRun(status)
+			r.HasChanges = true
+			c := newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{r}}})
+
+			output, err := c.Run(context.Background(), RunOptions{
+				Type:              RunTypeApply,
+				WaitForCompletion: true,
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tfe.Bool(true), output.HasChanges)
+			assert.Equal(t, tfe.Bool(applied), output.Applied)
+		})
+	}
+}
+
+func TestRun_planQueueLatency(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := testRun(tfe.RunApplied)
+	r.CreatedAt = createdAt
+	r.StatusTimestamps = &tfe.RunStatusTimestamps{
+		PlanQueuedAt: createdAt.Add(5 * time.Second),
+		PlanningAt:   createdAt.Add(42 * time.Second),
+		AppliedAt:    createdAt.Add(3 * time.Minute),
+	}
+	c := newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{r}}})
+
+	output, err := c.Run(context.Background(), RunOptions{Type: RunTypeApply, WaitForCompletion: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 42*time.Second, *output.PlanQueueLatency)
+}
+
+func TestPlanQueueLatency_missingTimestamps(t *testing.T) {
+	r := testRun(tfe.RunErrored)
+	assert.Nil(t, planQueueLatency(r))
+
+	r.StatusTimestamps = &tfe.RunStatusTimestamps{ErroredAt: time.Now()}
+	r.CreatedAt = time.Now()
+	assert.Nil(t, planQueueLatency(r))
+}
+
+func TestRun_terraformVersion(t *testing.T) {
+	r := testRun(tfe.RunPlannedAndFinished)
+	r.TerraformVersion = "1.9.5"
+	c := newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{r}}})
+	c.workspace.TerraformVersion = "1.8.0"
+
+	output, err := c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "1.9.5", output.TerraformVersion)
+}
+
+func TestRun_terraformVersionOfWorkspace(t *testing.T) {
+	c := newTestClient(&tfe.Client{Runs: &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlannedAndFinished)}}})
+	c.workspace.TerraformVersion = "1.8.0"
+
+	output, err := c.Run(context.Background(), RunOptions{Type: RunTypePlan, WaitForCompletion: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "1.8.0", output.TerraformVersion)
+}
+
+func TestRun_driftWithoutChanges(t *testing.T) {
+	runs := &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunPlanning), testRun(tfe.RunPlannedAndFinished)}}
+	c := newTestClient(&tfe.Client{
+		Runs: runs,
+		Plans: &fakePlans{json: `{
+  "format_version": "1.2",
+  "resource_drift": [
+    {"address": "null_resource.a", "change": {"actions": ["update"]}},
+    {"address": "null_resource.b", "change": {"actions": ["delete"]}}
+  ],
+  "resource_changes": [
+    {"address": "null_resource.a", "change": {"actions": ["no-op"]}}
+  ]
+}`},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypePlan,
+		WaitForCompletion: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, tfe.Bool(false), output.HasChanges)
+	assert.Equal(t, tfe.Int(2), output.DriftCount)
+}
+
+func TestRun_unreadableJSONPlan(t *testing.T) {
+	c := newTestClient(&tfe.Client{
+		Runs:          &fakeRuns{reads: []*tfe.Run{testRun(tfe.RunApplied)}},
+		Plans:         &fakePlans{json: `{}`},
+		StateVersions: &fakeStateVersions{},
+	})
+
+	output, err := c.Run(context.Background(), RunOptions{
+		Type:              RunTypeApply,
+		WaitForCompletion: true,
+	})
+
+	assert.NoError(t, err, "JSON plan is informational")
+	assert.Nil(t, output.DriftCount)
+	assert.Nil(t, output.ChangedResources)
+}